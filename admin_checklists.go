@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	eventChecklistReassigned = "checklist.reassigned"
+	eventChecklistMerged     = "checklist.merged"
+
+	// maxReassignBatch bounds the number of checklists moved by one request.
+	maxReassignBatch = 500
+)
+
+type reassignInput struct {
+	ChecklistIDs []int64 `json:"checklistIds"`
+	ChildID      *int64  `json:"childId"`
+	ChildName    string  `json:"childName"`
+}
+
+// checklistChild is the child a checklist is filed under and its date.
+type checklistChild struct {
+	id   sql.NullInt64
+	name sql.NullString
+	date sql.NullTime
+}
+
+// reassignedChecklist reports one moved checklist and its former child.
+type reassignedChecklist struct {
+	ID   int64   `json:"id"`
+	From *string `json:"from"`
+}
+
+// reassignChecklistsHandler handles POST /api/admin/checklists/reassign: it
+// moves checklists filed under the wrong child to another child. Every moved
+// checklist gets its own checklist.reassigned event, which is what the audit
+// export shows. The request is all or nothing: an unknown id fails it, and
+// so does a checklist dated before the birth of the target child.
+//
+// The target is a stored child (childId) or, for children not in the
+// registry, a free-text name; moving by name unlinks the checklists from
+// the registry.
+func reassignChecklistsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var in reassignInput
+	warnings, err := decodeJSON(r.Body, &in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	in.ChildName = strings.TrimSpace(in.ChildName)
+	if in.ChildID == nil && in.ChildName == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "childId or childName must be provided")
+		return
+	}
+	if len(in.ChecklistIDs) == 0 || len(in.ChecklistIDs) > maxReassignBatch {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("checklistIds must contain 1 to %d ids", maxReassignBatch))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var (
+		moved []reassignedChecklist
+		notes []string
+	)
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		moved, notes = []reassignedChecklist{}, nil
+		current, err := lockChecklistChildren(ctx, tx, in.ChecklistIDs)
+		if err != nil {
+			return fmt.Errorf("lock checklists: %w", err)
+		}
+		var missing, beforeBirth []int64
+		for _, id := range in.ChecklistIDs {
+			from, ok := current[id]
+			if !ok {
+				missing = append(missing, id)
+				continue
+			}
+			c := Checklist{ChildID: in.ChildID}
+			switch err := linkChild(ctx, tx, &c, from.date); {
+			case errors.Is(err, errUnknownChild):
+				return newStatusError(http.StatusBadRequest, codeBadRequest, err.Error())
+			case errors.Is(err, errCheckBeforeBirth):
+				beforeBirth = append(beforeBirth, id)
+			case err != nil:
+				return err
+			case c.ChildName != nil:
+				in.ChildName = *c.ChildName
+			}
+		}
+		if len(missing) > 0 {
+			return &statusError{status: http.StatusNotFound, code: codeNotFound, message: "checklists not found",
+				details: map[string]interface{}{"missingIds": missing}}
+		}
+		if len(beforeBirth) > 0 {
+			return &statusError{status: http.StatusBadRequest, code: codeBadRequest, message: errCheckBeforeBirth.Error(),
+				details: map[string]interface{}{"beforeBirthIds": beforeBirth}}
+		}
+
+		for _, id := range in.ChecklistIDs {
+			from, ok := current[id]
+			if !ok {
+				continue // listed twice, already handled
+			}
+			delete(current, id)
+			same := from.name.Valid && from.name.String == in.ChildName
+			if in.ChildID != nil {
+				same = from.id.Valid && from.id.Int64 == *in.ChildID
+			}
+			if same {
+				notes = append(notes, fmt.Sprintf("checklist %d already belongs to %q", id, in.ChildName))
+				continue
+			}
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE checklists SET child_name = $2, child_id = $3, updated_at = now() WHERE id = $1`,
+				id, in.ChildName, in.ChildID); err != nil {
+				return fmt.Errorf("reassign checklist %d: %w", id, err)
+			}
+			moved = append(moved, reassignedChecklist{ID: id, From: stringPtr(from.name)})
+		}
+
+		movedIDs := make([]int64, len(moved))
+		for i, m := range moved {
+			movedIDs[i] = m.ID
+		}
+		if err := refreshSearchVectors(ctx, tx, movedIDs...); err != nil {
+			return fmt.Errorf("index checklists: %w", err)
+		}
+
+		for _, m := range moved {
+			payload := map[string]interface{}{"id": m.ID, "from": m.From, "to": in.ChildName, "childId": in.ChildID}
+			if err := appendEvent(ctx, tx, eventChecklistReassigned, m.ID, payload); err != nil {
+				return fmt.Errorf("append event: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to reassign checklists")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	warnings = append(warnings, notes...)
+	resp := map[string]interface{}{"childId": in.ChildID, "childName": in.ChildName, "moved": moved, "warnings": nonNilWarnings(warnings)}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+type mergeInput struct {
+	TargetID int64 `json:"targetId"`
+	SourceID int64 `json:"sourceId"`
+	Force    bool  `json:"force"` // merge checklists of different children
+}
+
+// mergeConflict is a question answered differently in the two merged
+// checklists.
+type mergeConflict struct {
+	Key         string  `json:"key"`
+	TargetValue *string `json:"targetValue"`
+	SourceValue *string `json:"sourceValue"`
+	Kept        string  `json:"kept"` // target or source
+}
+
+// mergeChecklistsHandler handles POST /api/admin/checklists/merge: two
+// partial submissions of the same assessment session are merged into the
+// target checklist and the source checklist is archived. Answers are merged
+// by key; where both have a different answer the newer checklist (by
+// created_at) wins and the key is listed in conflicts. Missing metadata of
+// the target is taken from the source. Checklists of different children are
+// merged only with force.
+func mergeChecklistsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var in mergeInput
+	warnings, err := decodeJSON(r.Body, &in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	if in.TargetID <= 0 || in.SourceID <= 0 || in.TargetID == in.SourceID {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "targetId and sourceId must be two different checklist ids")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var (
+		merged    ChecklistDetail
+		conflicts []mergeConflict
+	)
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		createdAt, archived, err := lockMergedChecklists(ctx, tx, in.TargetID, in.SourceID)
+		if err != nil {
+			return fmt.Errorf("lock checklists: %w", err)
+		}
+		if len(createdAt) < 2 {
+			return newStatusError(http.StatusNotFound, codeNotFound, "checklist not found")
+		}
+		if archived {
+			return newStatusError(http.StatusConflict, codeConflict, "checklist is archived")
+		}
+
+		sourceNewer := createdAt[in.SourceID].After(createdAt[in.TargetID])
+		if merged, conflicts, err = mergeChecklists(ctx, tx, in.TargetID, in.SourceID, sourceNewer, in.Force); err != nil {
+			return fmt.Errorf("merge checklist %d into %d: %w", in.SourceID, in.TargetID, err)
+		}
+
+		payload := map[string]interface{}{"id": in.TargetID, "sourceId": in.SourceID, "conflicts": len(conflicts)}
+		return appendEvent(ctx, tx, eventChecklistMerged, in.TargetID, payload)
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to merge checklists")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"checklist": merged, "conflicts": conflicts, "warnings": nonNilWarnings(warnings)}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// mergeChecklists merges checklist sourceID into targetID within tx, archives
+// the source and returns the merged checklist. Unless force is set, it
+// refuses checklists of different children.
+func mergeChecklists(ctx context.Context, tx *sql.Tx, targetID, sourceID int64, sourceNewer, force bool) (ChecklistDetail, []mergeConflict, error) {
+	target, err := loadChecklist(ctx, tx, targetID)
+	if err != nil {
+		return target, nil, err
+	}
+	source, err := loadChecklist(ctx, tx, sourceID)
+	if err != nil {
+		return target, nil, err
+	}
+	if !force && !sameChild(target.Checklist, source.Checklist) {
+		return target, nil, newStatusError(http.StatusConflict, codeConflict,
+			"checklists belong to different children; set force to merge them anyway")
+	}
+
+	patch, conflicts := mergeAnswers(target, source, sourceNewer)
+	if err := patchChecklist(ctx, tx, targetID, patch, mergeDate(target, source), sql.NullTime{}); err != nil {
+		return target, nil, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE checklists SET archived_at = now(), merged_into = $2, updated_at = now() WHERE id = $1`,
+		sourceID, targetID); err != nil {
+		return target, nil, fmt.Errorf("archive checklist: %w", err)
+	}
+	if err := refreshSearchVectors(ctx, tx, targetID); err != nil {
+		return target, nil, fmt.Errorf("index checklist: %w", err)
+	}
+
+	merged, err := loadChecklist(ctx, tx, targetID)
+	return merged, conflicts, err
+}
+
+// lockMergedChecklists locks the two checklists of a merge and returns the
+// created_at of those found and whether any of them is archived.
+func lockMergedChecklists(ctx context.Context, tx *sql.Tx, targetID, sourceID int64) (map[int64]time.Time, bool, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, created_at, archived_at FROM checklists WHERE id IN ($1, $2) AND org_id = $3 ORDER BY id FOR UPDATE`,
+		targetID, sourceID, orgFrom(ctx))
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	createdAt := make(map[int64]time.Time, 2)
+	archived := false
+	for rows.Next() {
+		var (
+			id         int64
+			created    time.Time
+			archivedAt sql.NullTime
+		)
+		if err := rows.Scan(&id, &created, &archivedAt); err != nil {
+			return nil, false, err
+		}
+		createdAt[id] = created
+		archived = archived || archivedAt.Valid
+	}
+	return createdAt, archived, rows.Err()
+}
+
+// lockChecklistChildren locks the given checklists for update and returns
+// their current children and dates by id; unknown ids are absent from the
+// result.
+func lockChecklistChildren(ctx context.Context, tx *sql.Tx, ids []int64) (map[int64]checklistChild, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, child_id, child_name, date_of_check FROM checklists WHERE id = ANY($1) AND org_id = $2 ORDER BY id FOR UPDATE`,
+		pq.Array(ids), orgFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	children := make(map[int64]checklistChild, len(ids))
+	for rows.Next() {
+		var (
+			id    int64
+			child checklistChild
+		)
+		if err := rows.Scan(&id, &child.id, &child.name, &child.date); err != nil {
+			return nil, err
+		}
+		children[id] = child
+	}
+	return children, rows.Err()
+}
+
+// mergeAnswers returns the patch that merges source into target and the
+// conflicting keys. Keys answered only in source are added; keys answered
+// in both take the newer checklist's answer.
+func mergeAnswers(target, source ChecklistDetail, sourceNewer bool) (Checklist, []mergeConflict) {
+	var patch Checklist
+	if target.ChildID == nil && source.ChildID != nil {
+		patch.ChildID, patch.ChildName = source.ChildID, source.ChildName
+	} else if target.ChildName == nil {
+		patch.ChildName = source.ChildName
+	}
+	if target.SpecialistID == nil {
+		patch.SpecialistID = source.SpecialistID
+	}
+	if target.Specialist == nil {
+		patch.Specialist = source.Specialist
+	}
+
+	existing := make(map[string]Answer, len(target.Answers))
+	for _, a := range target.Answers {
+		existing[a.Key] = a
+	}
+	conflicts := []mergeConflict{}
+	for _, a := range source.Answers {
+		t, ok := existing[a.Key]
+		if !ok {
+			patch.Answers = append(patch.Answers, a)
+			existing[a.Key] = a
+			continue
+		}
+		if equalStringPtr(t.Value, a.Value) && equalStringPtr(t.Comment, a.Comment) {
+			continue
+		}
+		c := mergeConflict{Key: a.Key, TargetValue: t.Value, SourceValue: a.Value, Kept: "target"}
+		if sourceNewer {
+			c.Kept = "source"
+			patch.Answers = append(patch.Answers, a)
+		}
+		conflicts = append(conflicts, c)
+	}
+	return patch, conflicts
+}
+
+// sameChild reports whether two checklists may be of the same child: linked
+// ones are compared by child id, the others by name, and a checklist
+// without a child matches any.
+func sameChild(a, b Checklist) bool {
+	if a.ChildID != nil && b.ChildID != nil {
+		return *a.ChildID == *b.ChildID
+	}
+	if a.ChildName == nil || b.ChildName == nil {
+		return true
+	}
+	return strings.EqualFold(strings.TrimSpace(*a.ChildName), strings.TrimSpace(*b.ChildName))
+}
+
+// mergeDate returns the examination date to set on the merged checklist:
+// the source's date when the target has none.
+func mergeDate(target, source ChecklistDetail) sql.NullTime {
+	if target.Date != nil || source.Date == nil {
+		return sql.NullTime{}
+	}
+	t, err := time.Parse("2006-01-02", *source.Date)
+	if err != nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t, Valid: true}
+}
+
+func equalStringPtr(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
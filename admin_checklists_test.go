@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func ptr[T any](v T) *T { return &v }
+
+func TestMergeAnswers(t *testing.T) {
+	target := ChecklistDetail{ID: 1, Checklist: Checklist{
+		Answers: []Answer{
+			{Key: "speech", Value: ptr("Да")},
+			{Key: "hearing", Value: ptr("Нет")},
+			{Key: "motor", Value: ptr("Да"), Comment: ptr("ok")},
+		},
+	}}
+	source := ChecklistDetail{ID: 2, Checklist: Checklist{
+		ChildName:    ptr("Иванов Иван"),
+		ChildID:      ptr(int64(7)),
+		Specialist:   ptr("Петрова"),
+		SpecialistID: ptr(int64(3)),
+		Answers: []Answer{
+			{Key: "speech", Value: ptr("Да")},
+			{Key: "hearing", Value: ptr("Частично")},
+			{Key: "motor", Value: ptr("Да"), Comment: ptr("checked twice")},
+			{Key: "vision", Value: ptr("Да")},
+		},
+	}}
+
+	tests := []struct {
+		name        string
+		sourceNewer bool
+		answers     []string
+		kept        string
+	}{
+		{name: "target newer", sourceNewer: false, answers: []string{"vision"}, kept: "target"},
+		{name: "source newer", sourceNewer: true, answers: []string{"hearing", "motor", "vision"}, kept: "source"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, conflicts := mergeAnswers(target, source, tt.sourceNewer)
+			var keys []string
+			for _, a := range patch.Answers {
+				keys = append(keys, a.Key)
+			}
+			if !reflect.DeepEqual(keys, tt.answers) {
+				t.Errorf("patched answers = %v, want %v", keys, tt.answers)
+			}
+			if len(conflicts) != 2 || conflicts[0].Key != "hearing" || conflicts[1].Key != "motor" {
+				t.Fatalf("conflicts = %+v, want hearing and motor", conflicts)
+			}
+			for _, c := range conflicts {
+				if c.Kept != tt.kept {
+					t.Errorf("conflict %s kept %s, want %s", c.Key, c.Kept, tt.kept)
+				}
+			}
+			if patch.ChildID == nil || *patch.ChildID != 7 || patch.ChildName == nil || *patch.ChildName != "Иванов Иван" {
+				t.Errorf("child = %v %v, want 7 Иванов Иван", patch.ChildID, patch.ChildName)
+			}
+			if patch.SpecialistID == nil || *patch.SpecialistID != 3 || patch.Specialist == nil || *patch.Specialist != "Петрова" {
+				t.Errorf("specialist = %v %v, want 3 Петрова", patch.SpecialistID, patch.Specialist)
+			}
+		})
+	}
+}
+
+func TestMergeAnswersKeepsTargetMetadata(t *testing.T) {
+	target := ChecklistDetail{ID: 1, Checklist: Checklist{ChildName: ptr("Иванов Иван"), ChildID: ptr(int64(7)),
+		Specialist: ptr("Петрова"), SpecialistID: ptr(int64(3))}}
+	source := ChecklistDetail{ID: 2, Checklist: Checklist{ChildName: ptr("Иванов И."), ChildID: ptr(int64(8)),
+		Specialist: ptr("Сидорова"), SpecialistID: ptr(int64(4))}}
+	patch, conflicts := mergeAnswers(target, source, true)
+	if patch.ChildID != nil || patch.ChildName != nil || patch.SpecialistID != nil || patch.Specialist != nil {
+		t.Errorf("patch = %+v, want the target's child and specialist kept", patch)
+	}
+	if len(conflicts) != 0 {
+		t.Errorf("conflicts = %+v, want none", conflicts)
+	}
+}
+
+func TestSameChild(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Checklist
+		want bool
+	}{
+		{"same id", Checklist{ChildID: ptr(int64(1)), ChildName: ptr("A")}, Checklist{ChildID: ptr(int64(1)), ChildName: ptr("B")}, true},
+		{"different ids", Checklist{ChildID: ptr(int64(1)), ChildName: ptr("A")}, Checklist{ChildID: ptr(int64(2)), ChildName: ptr("A")}, false},
+		{"same name", Checklist{ChildName: ptr(" Иванов Иван")}, Checklist{ChildName: ptr("иванов иван ")}, true},
+		{"different names", Checklist{ChildName: ptr("Иванов Иван")}, Checklist{ChildName: ptr("Петров Пётр")}, false},
+		{"one linked", Checklist{ChildID: ptr(int64(1)), ChildName: ptr("Иванов Иван")}, Checklist{ChildName: ptr("Петров Пётр")}, false},
+		{"no child", Checklist{}, Checklist{ChildID: ptr(int64(1)), ChildName: ptr("A")}, true},
+	}
+	for _, tt := range tests {
+		if got := sameChild(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: sameChild = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	eventAnnouncementCreated = "announcement.created"
+	eventAnnouncementUpdated = "announcement.updated"
+	eventAnnouncementDeleted = "announcement.deleted"
+)
+
+// Announcement is a notice shown to all users of an organization as a
+// banner, e.g. planned maintenance. It is visible between StartsAt and
+// EndsAt (open-ended when nil).
+type Announcement struct {
+	ID        int64      `json:"id"`
+	Message   string     `json:"message"`
+	Level     string     `json:"level"` // info or warning
+	StartsAt  *time.Time `json:"startsAt"`
+	EndsAt    *time.Time `json:"endsAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+type announcementInput struct {
+	Message  string     `json:"message"`
+	Level    string     `json:"level"`
+	StartsAt *time.Time `json:"startsAt"`
+	EndsAt   *time.Time `json:"endsAt"`
+}
+
+func (in *announcementInput) validate() error {
+	in.Message = strings.TrimSpace(in.Message)
+	if in.Message == "" {
+		return fmt.Errorf("message must be provided")
+	}
+	switch in.Level {
+	case "":
+		in.Level = "info"
+	case "info", "warning":
+	default:
+		return fmt.Errorf("level must be info or warning")
+	}
+	if in.StartsAt != nil && in.EndsAt != nil && !in.EndsAt.After(*in.StartsAt) {
+		return fmt.Errorf("endsAt must be after startsAt")
+	}
+	return nil
+}
+
+// activeAnnouncementsHandler handles GET /api/announcements: the notices that
+// are currently visible. The frontend polls it.
+func activeAnnouncementsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	listAnnouncements(w, r, true)
+}
+
+// adminAnnouncementsHandler handles GET (all) and POST on /api/admin/announcements
+func adminAnnouncementsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listAnnouncements(w, r, false)
+	case http.MethodPost:
+		saveAnnouncement(w, r, 0)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// adminAnnouncementHandler handles PUT and DELETE on /api/admin/announcements/{id}
+func adminAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid announcement id")
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		saveAnnouncement(w, r, id)
+	case http.MethodDelete:
+		deleteAnnouncement(w, r, id)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+func listAnnouncements(w http.ResponseWriter, r *http.Request, activeOnly bool) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	query := `SELECT id, message, level, starts_at, ends_at, created_at FROM announcements WHERE org_id = $1`
+	if activeOnly {
+		query += ` AND (starts_at IS NULL OR starts_at <= now()) AND (ends_at IS NULL OR ends_at > now())`
+	}
+	query += ` ORDER BY COALESCE(starts_at, created_at) DESC, id DESC`
+
+	rows, err := db.QueryContext(ctx, query, orgFrom(ctx))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list announcements")
+		log.Printf("list announcements error: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	items := []Announcement{}
+	for rows.Next() {
+		a, err := scanAnnouncement(rows)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list announcements")
+			log.Printf("scan announcement error: %v", err)
+			return
+		}
+		items = append(items, a)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list announcements")
+		log.Printf("list announcements error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+}
+
+// saveAnnouncement creates an announcement (id == 0) or replaces an existing one.
+func saveAnnouncement(w http.ResponseWriter, r *http.Request, id int64) {
+	var in announcementInput
+	warnings, err := decodeJSON(r.Body, &in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	if err := in.validate(); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	status, event := http.StatusCreated, eventAnnouncementCreated
+	if id != 0 {
+		status, event = http.StatusOK, eventAnnouncementUpdated
+	}
+	var a Announcement
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		var row *sql.Row
+		if id == 0 {
+			row = tx.QueryRowContext(ctx,
+				`INSERT INTO announcements (message, level, starts_at, ends_at, org_id) VALUES ($1, $2, $3, $4, $5)
+                 RETURNING id, message, level, starts_at, ends_at, created_at`,
+				in.Message, in.Level, in.StartsAt, in.EndsAt, orgFrom(ctx))
+		} else {
+			row = tx.QueryRowContext(ctx,
+				`UPDATE announcements SET message = $2, level = $3, starts_at = $4, ends_at = $5 WHERE id = $1 AND org_id = $6
+                 RETURNING id, message, level, starts_at, ends_at, created_at`,
+				id, in.Message, in.Level, in.StartsAt, in.EndsAt, orgFrom(ctx))
+		}
+		var err error
+		a, err = scanAnnouncement(row)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newStatusError(http.StatusNotFound, codeNotFound, "announcement not found")
+		}
+		if err != nil {
+			return err
+		}
+		return appendEvent(ctx, tx, event, a.ID, a)
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to save announcement")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	resp := struct {
+		Announcement
+		Warnings []string `json:"warnings"`
+	}{a, nonNilWarnings(warnings)}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func deleteAnnouncement(w http.ResponseWriter, r *http.Request, id int64) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	err := inTx(ctx, nil, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `DELETE FROM announcements WHERE id = $1 AND org_id = $2`, id, orgFrom(ctx))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return newStatusError(http.StatusNotFound, codeNotFound, "announcement not found")
+		}
+		return appendEvent(ctx, tx, eventAnnouncementDeleted, id, map[string]interface{}{"id": id})
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to delete announcement")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func scanAnnouncement(row rowScanner) (Announcement, error) {
+	var (
+		a            Announcement
+		starts, ends sql.NullTime
+	)
+	if err := row.Scan(&a.ID, &a.Message, &a.Level, &starts, &ends, &a.CreatedAt); err != nil {
+		return a, err
+	}
+	a.StartsAt, a.EndsAt = timePtr(starts), timePtr(ends)
+	return a, nil
+}
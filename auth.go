@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Token lifetimes used unless JWT_ACCESS_TTL / JWT_REFRESH_TTL say otherwise.
+const (
+	defaultAccessTTL  = 15 * time.Minute
+	defaultRefreshTTL = 30 * 24 * time.Hour
+
+	minJWTSecretLen   = 32
+	minPasswordLength = 8
+	jwtIssuer         = "check_list_tnr"
+)
+
+// Authentication settings. Authentication is on when JWT_SECRET is set.
+var (
+	authEnabled bool
+	jwtSecret   []byte
+	accessTTL   = defaultAccessTTL
+	refreshTTL  = defaultRefreshTTL
+
+	// adminLogin (ADMIN_LOGIN) is the account that always has the admin role.
+	adminLogin string
+)
+
+// publicPaths are the /api routes reachable without an access token.
+var publicPaths = map[string]bool{
+	"/api/auth/login":   true,
+	"/api/auth/refresh": true,
+}
+
+var (
+	errInvalidToken = errors.New("invalid or expired token")
+
+	// dummyPasswordHash is compared against when the login is unknown, so
+	// that a failed login takes the same time whether or not the login exists.
+	dummyPasswordHash []byte
+)
+
+type authKey struct{}
+
+// authClaims are the claims of an access token.
+type authClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"` // specialist id
+	Login     string `json:"login"`
+	Role      string `json:"role"`
+	Org       int64  `json:"org"` // organization id
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// SpecialistID returns the id of the authenticated specialist.
+func (c authClaims) SpecialistID() int64 {
+	id, _ := strconv.ParseInt(c.Subject, 10, 64)
+	return id
+}
+
+// authFrom returns the claims of the request's access token, or nil when
+// authentication is off.
+func authFrom(ctx context.Context) *authClaims {
+	c, _ := ctx.Value(authKey{}).(*authClaims)
+	return c
+}
+
+// configureAuth reads JWT_SECRET, JWT_ACCESS_TTL, JWT_REFRESH_TTL and
+// ADMIN_LOGIN.
+func configureAuth() {
+	adminLogin = strings.ToLower(strings.TrimSpace(os.Getenv("ADMIN_LOGIN")))
+	secret := secretEnv("JWT_SECRET")
+	if secret == "" {
+		log.Printf("JWT_SECRET is not set: the API is not protected by authentication")
+		return
+	}
+	if len(secret) < minJWTSecretLen {
+		log.Fatalf("JWT_SECRET must be at least %d bytes long", minJWTSecretLen)
+	}
+	authEnabled, jwtSecret = true, []byte(secret)
+
+	for _, s := range []struct {
+		name string
+		ttl  *time.Duration
+	}{{"JWT_ACCESS_TTL", &accessTTL}, {"JWT_REFRESH_TTL", &refreshTTL}} {
+		v := os.Getenv(s.name)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("%s must be a positive duration, got %q", s.name, v)
+		}
+		*s.ttl = d
+	}
+
+	var err error
+	if dummyPasswordHash, err = bcrypt.GenerateFromPassword([]byte(jwtIssuer), bcrypt.DefaultCost); err != nil {
+		log.Fatalf("failed to prepare password hashing: %v", err)
+	}
+}
+
+// bootstrapAdmin creates the account ADMIN_LOGIN with password
+// ADMIN_PASSWORD when no specialist has that login yet, so that a fresh
+// installation with authentication on can be logged into, and gives the
+// ADMIN_LOGIN account the admin role.
+func bootstrapAdmin() {
+	login, password := adminLogin, secretEnv("ADMIN_PASSWORD")
+	if login == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if password != "" {
+		if len(password) < minPasswordLength {
+			log.Fatalf("ADMIN_PASSWORD must be at least %d characters long", minPasswordLength)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatalf("failed to hash ADMIN_PASSWORD: %v", err)
+		}
+		var n int64
+		err = inTx(ctx, nil, func(tx *sql.Tx) error {
+			res, err := tx.ExecContext(ctx,
+				`INSERT INTO specialists (org_id, name, login, password_hash, role) VALUES ($4, $1, $1, $2, $3) ON CONFLICT (login) DO NOTHING`,
+				login, string(hash), roleAdmin, defaultOrgID)
+			if err != nil {
+				return err
+			}
+			n, _ = res.RowsAffected()
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("failed to create admin account: %v", err)
+		}
+		if n > 0 {
+			log.Printf("created admin account %q", login)
+		}
+	}
+	var n int64
+	err := inTx(ctx, nil, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE specialists SET role = $2, updated_at = now() WHERE login = $1 AND role <> $2`,
+			login, roleAdmin)
+		if err != nil {
+			return err
+		}
+		n, _ = res.RowsAffected()
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("failed to grant the admin role to %q: %v", login, err)
+	}
+	if n > 0 {
+		log.Printf("granted the admin role to %q", login)
+	}
+}
+
+// authMiddleware requires a valid access token in the Authorization header
+// on every /api route except publicPaths, checks that its role is allowed
+// the request (see requiredRole) and puts its claims in the request context.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			writeUnauthorized(w, r, `Bearer realm="api"`, "missing bearer token")
+			return
+		}
+		claims, err := parseAccessToken(strings.TrimSpace(token), time.Now())
+		if err != nil {
+			writeUnauthorized(w, r, `Bearer realm="api", error="invalid_token"`, err.Error())
+			return
+		}
+		if role := requiredRole(r); !claims.hasRole(role) {
+			writeError(w, r, http.StatusForbidden, codeForbidden, fmt.Sprintf("this request requires the %s role", role))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authKey{}, &claims)))
+	})
+}
+
+// writeUnauthorized answers 401 with the WWW-Authenticate challenge and,
+// with OIDC on, a Link header telling the frontend where to log in.
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, challenge, msg string) {
+	w.Header().Set("WWW-Authenticate", challenge)
+	if oidc != nil {
+		w.Header().Set("Link", `</api/auth/oidc/login>; rel="login"`)
+	}
+	writeError(w, r, http.StatusUnauthorized, codeUnauthorized, msg)
+}
+
+type loginInput struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+// tokenResponse is returned by login and refresh.
+type tokenResponse struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int64  `json:"expiresIn"` // seconds until the access token expires
+}
+
+// loginHandler handles POST /api/auth/login: it checks the password of an
+// active specialist and issues an access and a refresh token.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	var in loginInput
+	if _, err := decodeJSON(r.Body, &in); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	login := strings.ToLower(strings.TrimSpace(in.Login))
+	if login == "" || in.Password == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "login and password must be provided")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var (
+		id, org    int64
+		hash, role sql.NullString
+	)
+	// no organization is known before the login, so the lookup runs with the
+	// system role of unauthenticated requests
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx,
+			`SELECT id, org_id, password_hash, role FROM specialists WHERE login = $1 AND deactivated_at IS NULL`,
+			login).Scan(&id, &org, &hash, &role)
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load account")
+		log.Printf("login lookup error: %v", err)
+		return
+	}
+	if !hash.Valid {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(in.Password))
+		writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "invalid login or password")
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash.String), []byte(in.Password)) != nil {
+		writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "invalid login or password")
+		return
+	}
+
+	var resp tokenResponse
+	err = inTx(ctx, nil, func(tx *sql.Tx) (err error) {
+		resp, err = issueTokens(ctx, tx, id, login, role.String, org)
+		return err
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to issue tokens")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// refreshHandler handles POST /api/auth/refresh: it exchanges a refresh
+// token for a new pair. Each refresh token can be used once; presenting a
+// used one again revokes all refresh tokens of the account, since it means
+// the token was copied.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	var in struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if _, err := decodeJSON(r.Body, &in); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	if in.RefreshToken == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "refreshToken must be provided")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var (
+		resp         tokenResponse
+		reused       bool
+		specialistID int64
+	)
+	err := inTx(ctx, nil, func(tx *sql.Tx) error {
+		var (
+			tokenID, org         int64
+			login                sql.NullString
+			role                 string
+			revoked, deactivated sql.NullTime
+			expiresAt            time.Time
+		)
+		// the role is read anew, so a changed role applies from the next refresh
+		err := tx.QueryRowContext(ctx, `
+SELECT t.id, t.specialist_id, t.expires_at, t.revoked_at, s.login, s.role, s.org_id, s.deactivated_at
+FROM refresh_tokens t JOIN specialists s ON s.id = t.specialist_id
+WHERE t.token_hash = $1
+FOR UPDATE OF t`, hashRefreshToken(in.RefreshToken)).Scan(&tokenID, &specialistID, &expiresAt, &revoked, &login, &role, &org, &deactivated)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newStatusError(http.StatusUnauthorized, codeUnauthorized, errInvalidToken.Error())
+		}
+		if err != nil {
+			return fmt.Errorf("load refresh token: %w", err)
+		}
+		// the revocation is committed, the client still gets 401
+		if reused = revoked.Valid; reused {
+			_, err := tx.ExecContext(ctx,
+				`UPDATE refresh_tokens SET revoked_at = now() WHERE specialist_id = $1 AND revoked_at IS NULL`, specialistID)
+			return err
+		}
+		if !expiresAt.After(time.Now()) || deactivated.Valid || !login.Valid {
+			return newStatusError(http.StatusUnauthorized, codeUnauthorized, errInvalidToken.Error())
+		}
+
+		if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = now() WHERE id = $1`, tokenID); err != nil {
+			return fmt.Errorf("revoke refresh token: %w", err)
+		}
+		resp, err = issueTokens(ctx, tx, specialistID, login.String, role, org)
+		return err
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to issue tokens")
+		return
+	}
+	if reused {
+		log.Printf("reused refresh token of specialist %d: all its refresh tokens revoked", specialistID)
+		writeError(w, r, http.StatusUnauthorized, codeUnauthorized, errInvalidToken.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// passwordInput is the body of PUT /api/specialists/{id}/password.
+type passwordInput struct {
+	loginInput
+	CurrentPassword string `json:"currentPassword"`
+}
+
+// specialistPasswordHandler handles PUT /api/specialists/{id}/password: it
+// sets the login and password of a specialist and revokes the refresh
+// tokens issued with the old password. With authentication on, accounts
+// can change only their own password, and must give the current one so
+// that a stolen access token is not enough; admins can change those of
+// their organization without it.
+func specialistPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid specialist id")
+		return
+	}
+	if c := authFrom(r.Context()); c != nil && c.SpecialistID() != id && !c.hasRole(roleAdmin) {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "only the specialist or the administrator can set this password")
+		return
+	}
+	var in passwordInput
+	warnings, err := decodeJSON(r.Body, &in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	c := authFrom(r.Context())
+	self := c != nil && c.SpecialistID() == id
+	if self && in.CurrentPassword == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "currentPassword must be provided")
+		return
+	}
+	login := strings.ToLower(strings.TrimSpace(in.Login))
+	if login == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "login must be provided")
+		return
+	}
+	if len(in.Password) < minPasswordLength {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest,
+			fmt.Sprintf("password must be at least %d characters long", minPasswordLength))
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(in.Password), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "password cannot be used")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		if self {
+			if err := checkCurrentPassword(ctx, tx, id, in.CurrentPassword); err != nil {
+				return err
+			}
+		}
+		res, err := tx.ExecContext(ctx,
+			`UPDATE specialists SET login = $2, password_hash = $3, updated_at = now() WHERE id = $1 AND org_id = $4`,
+			id, login, string(hash), orgFrom(ctx))
+		if isUniqueViolation(err) {
+			return newStatusError(http.StatusConflict, codeConflict, "login already exists")
+		}
+		if err != nil {
+			return fmt.Errorf("set password of specialist %d: %w", id, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return newStatusError(http.StatusNotFound, codeNotFound, "specialist not found")
+		}
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE refresh_tokens SET revoked_at = now() WHERE specialist_id = $1 AND revoked_at IS NULL`, id); err != nil {
+			return fmt.Errorf("revoke refresh tokens: %w", err)
+		}
+		return appendEvent(ctx, tx, eventSpecialistUpdated, id, map[string]interface{}{"id": id, "password": true})
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to set password")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "login": login, "warnings": nonNilWarnings(warnings)})
+}
+
+// checkCurrentPassword locks specialist id and checks its password. An
+// account without a password cannot prove who it is and gets one from an
+// admin.
+func checkCurrentPassword(ctx context.Context, tx *sql.Tx, id int64, password string) error {
+	var hash sql.NullString
+	err := tx.QueryRowContext(ctx, `SELECT password_hash FROM specialists WHERE id = $1 AND org_id = $2 FOR UPDATE`,
+		id, orgFrom(ctx)).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newStatusError(http.StatusNotFound, codeNotFound, "specialist not found")
+	}
+	if err != nil {
+		return fmt.Errorf("load password of specialist %d: %w", id, err)
+	}
+	if !hash.Valid {
+		return newStatusError(http.StatusForbidden, codeForbidden, "the account has no password; an administrator can set one")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash.String), []byte(password)) != nil {
+		return newStatusError(http.StatusForbidden, codeForbidden, "currentPassword is incorrect")
+	}
+	return nil
+}
+
+// issueTokens signs an access token and stores a new refresh token for the
+// specialist of organization org.
+func issueTokens(ctx context.Context, tx *sql.Tx, specialistID int64, login, role string, org int64) (tokenResponse, error) {
+	now := time.Now()
+	access, err := signAccessToken(authClaims{
+		Issuer:    jwtIssuer,
+		Subject:   strconv.FormatInt(specialistID, 10),
+		Login:     login,
+		Role:      role,
+		Org:       org,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(accessTTL).Unix(),
+	})
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return tokenResponse{}, err
+	}
+	refresh := base64.RawURLEncoding.EncodeToString(b)
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM refresh_tokens WHERE specialist_id = $1 AND expires_at < now()`, specialistID); err != nil {
+		return tokenResponse{}, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO refresh_tokens (specialist_id, token_hash, expires_at) VALUES ($1, $2, $3)`,
+		specialistID, hashRefreshToken(refresh), now.Add(refreshTTL)); err != nil {
+		return tokenResponse{}, err
+	}
+	return tokenResponse{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(accessTTL / time.Second),
+	}, nil
+}
+
+// hashRefreshToken is what refresh_tokens stores instead of the token.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// jwtHeader is the only header accepted: HS256.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// signAccessToken encodes claims as an HS256 JWT.
+func signAccessToken(claims authClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + jwtSignature(unsigned), nil
+}
+
+// parseAccessToken verifies the signature, issuer and expiry of an access
+// token and returns its claims.
+func parseAccessToken(token string, now time.Time) (authClaims, error) {
+	var claims authClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return claims, errInvalidToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(jwtSignature(parts[0]+"."+parts[1]))) {
+		return claims, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errInvalidToken
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errInvalidToken
+	}
+	// tokens issued before organizations existed carry no org and are
+	// replaced on the next refresh
+	if claims.Issuer != jwtIssuer || claims.SpecialistID() <= 0 || !validRole(claims.Role) || claims.Org <= 0 ||
+		now.Unix() >= claims.ExpiresAt {
+		return claims, errInvalidToken
+	}
+	return claims, nil
+}
+
+func jwtSignature(unsigned string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
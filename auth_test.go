@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// refresh exchanges token at refreshHandler and returns the status and the
+// new pair.
+func refresh(t *testing.T, token string) (int, tokenResponse) {
+	t.Helper()
+	rec := postJSON(t, refreshHandler, "/api/auth/refresh", map[string]string{"refreshToken": token})
+	var resp tokenResponse
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	testDB(t)
+	testAuth(t)
+
+	login, password := uniqueName("reuse-"), "correct horse"
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO specialists (name, login, password_hash) VALUES ($1, $1, $2)`, login, string(hash)); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := postJSON(t, loginHandler, "/api/auth/login", loginInput{Login: login, Password: password})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", rec.Code, rec.Body)
+	}
+	var first tokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &first); err != nil {
+		t.Fatal(err)
+	}
+
+	code, second := refresh(t, first.RefreshToken)
+	if code != http.StatusOK || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("first refresh: %d, new token %q", code, second.RefreshToken)
+	}
+	if code, _ := refresh(t, first.RefreshToken); code != http.StatusUnauthorized {
+		t.Fatalf("reused token: %d, want 401", code)
+	}
+	// the reuse revoked the token issued by the legitimate refresh too
+	if code, _ := refresh(t, second.RefreshToken); code != http.StatusUnauthorized {
+		t.Fatalf("token issued before the reuse: %d, want 401", code)
+	}
+	if code, _ := refresh(t, "not-a-token"); code != http.StatusUnauthorized {
+		t.Fatalf("unknown token: %d, want 401", code)
+	}
+}
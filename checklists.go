@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page size bounds for GET /api/checklist.
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+// ChecklistSummary is the short form of a checklist used in listings.
+type ChecklistSummary struct {
+	ID               int64      `json:"id"`
+	ChildID          *int64     `json:"childId"`
+	ChildName        *string    `json:"childName"`
+	Date             *string    `json:"date"`
+	SpecialistID     *int64     `json:"specialistId"`
+	Specialist       *string    `json:"specialist"`
+	ClientCreatedAt  *time.Time `json:"clientCreatedAt"`
+	ServerReceivedAt *time.Time `json:"serverReceivedAt"`
+	AnswerCount      int        `json:"answerCount"`
+}
+
+// ChecklistDetail is a stored checklist with its answers, in the same shape
+// as the POST body plus server-side fields.
+type ChecklistDetail struct {
+	ID int64 `json:"id"`
+	Checklist
+	ClientCreatedAt  *time.Time `json:"clientCreatedAt"`
+	ServerReceivedAt *time.Time `json:"serverReceivedAt"`
+	UpdatedAt        *time.Time `json:"updatedAt"`
+	ArchivedAt       *time.Time `json:"archivedAt,omitempty"`
+	MergedInto       *int64     `json:"mergedInto,omitempty"`
+}
+
+// checklistSummaryColumns selects a ChecklistSummary from checklists aliased as c.
+const checklistSummaryColumns = `c.id, c.child_id, c.child_name, c.date_of_check, c.specialist_id, c.specialist,
+  c.client_created_at, c.server_received_at,
+  (SELECT count(*) FROM answers ac WHERE ac.checklist_id = c.id)`
+
+// checklistHandler handles GET (list) and POST (create) on /api/checklist
+func checklistHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listChecklists(w, r)
+	case http.MethodPost:
+		createChecklist(w, r)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// listChecklists returns a page of checklists, newest examination date first,
+// selected with ?limit=&offset= and optionally filtered with ?child_id=,
+// ?specialist_id=, ?child=, ?specialist= (case-insensitive exact match),
+// ?from=&to= (inclusive examination date range, YYYY-MM-DD) and ?q=
+// (full-text search, best match first). Archived checklists are not listed.
+// The total number of matching checklists is returned in the X-Total-Count
+// header.
+func listChecklists(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, offset := defaultPageLimit, 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "limit must be between 1 and 200")
+			return
+		}
+		limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "offset must be a non-negative integer")
+			return
+		}
+		offset = n
+	}
+	where, order, args, err := checklistListFilter(orgFrom(r.Context()), q)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var (
+		total int64
+		items []ChecklistSummary
+	)
+	err = inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, `SELECT count(*) FROM checklists c`+where, args...).Scan(&total); err != nil {
+			return fmt.Errorf("count checklists: %w", err)
+		}
+
+		n := len(args)
+		rows, err := tx.QueryContext(ctx, `SELECT `+checklistSummaryColumns+` FROM checklists c`+where+`
+ORDER BY `+order+fmt.Sprintf(` LIMIT $%d OFFSET $%d`, n+1, n+2), append(args, limit, offset)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		items, err = scanChecklistSummaries(rows)
+		return err
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list checklists")
+		log.Printf("list checklists error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	resp := map[string]interface{}{"items": items, "limit": limit, "offset": offset, "total": total}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// checklistListFilter translates the filter parameters of GET /api/checklist
+// into a WHERE clause over the checklists of organization org aliased as c,
+// the ORDER BY list and their arguments.
+func checklistListFilter(org int64, q url.Values) (string, string, []interface{}, error) {
+	var (
+		conds = []string{"c.org_id = $1", "c.archived_at IS NULL"}
+		args  = []interface{}{org}
+	)
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if v := q.Get("child_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", "", nil, errors.New("child_id must be an integer")
+		}
+		add("c.child_id = $%d", id)
+	}
+	if v := q.Get("specialist_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", "", nil, errors.New("specialist_id must be an integer")
+		}
+		add("c.specialist_id = $%d", id)
+	}
+	if v := strings.TrimSpace(q.Get("child")); v != "" {
+		add("lower(c.child_name) = lower($%d)", v)
+	}
+	if v := strings.TrimSpace(q.Get("specialist")); v != "" {
+		add("lower(c.specialist) = lower($%d)", v)
+	}
+	var from time.Time
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return "", "", nil, errors.New("from must be YYYY-MM-DD")
+		}
+		from = t
+		add("c.date_of_check >= $%d", t)
+	}
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return "", "", nil, errors.New("to must be YYYY-MM-DD")
+		}
+		if !from.IsZero() && t.Before(from) {
+			return "", "", nil, errors.New("to must not be before from")
+		}
+		add("c.date_of_check <= $%d", t)
+	}
+	order := "c.date_of_check DESC NULLS LAST, c.id DESC"
+	if v := strings.TrimSpace(q.Get("q")); v != "" {
+		add("c.search_vector @@ "+searchQuery, v)
+		order = fmt.Sprintf("ts_rank(c.search_vector, "+searchQuery+") DESC, ", len(args)) + order
+	}
+	return "\nWHERE " + strings.Join(conds, " AND "), order, args, nil
+}
+
+// checklistItemHandler handles GET, PUT (replace) and PATCH (partial update)
+// on /api/checklist/{id}
+func checklistItemHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid checklist id")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		getChecklist(w, r, id)
+	case http.MethodPut:
+		updateChecklist(w, r, id, true)
+	case http.MethodPatch:
+		updateChecklist(w, r, id, false)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+func getChecklist(w http.ResponseWriter, r *http.Request, id int64) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var c ChecklistDetail
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		var err error
+		c, err = loadChecklist(ctx, tx, id)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "checklist not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load checklist")
+		log.Printf("load checklist %d error: %v", id, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(c)
+}
+
+// updateChecklist handles PUT and PATCH on /api/checklist/{id}. With replace
+// set the body is validated like a POST and the stored metadata and answers
+// are replaced as a whole. Otherwise only the fields present in the body are
+// changed and answers are merged by key: a known key gets the new label (when
+// not empty), value and comment, an unknown key is added. Either way the
+// change is applied in one transaction and the updated checklist is returned.
+func updateChecklist(w http.ResponseWriter, r *http.Request, id int64, replace bool) {
+	var in Checklist
+	warnings, err := decodeJSON(r.Body, &in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+
+	if replace && len(in.Answers) == 0 {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "answers must be provided")
+		return
+	}
+	for _, a := range in.Answers {
+		if a.Key == "" {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "answer key must not be empty")
+			return
+		}
+	}
+
+	var date sql.NullTime
+	if in.Date != nil && strings.TrimSpace(*in.Date) != "" {
+		if date, err = parseCheckDate(*in.Date); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
+	} else if replace {
+		date = sql.NullTime{Time: time.Now().Truncate(24 * time.Hour), Valid: true}
+		warnings = append(warnings, "date defaulted to today")
+	}
+
+	var clientCreatedAt sql.NullTime
+	if in.CreatedAt != nil && *in.CreatedAt != "" {
+		if clientCreatedAt, err = parseClientCreatedAt(*in.CreatedAt, time.Now().UTC()); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
+	}
+
+	warnings = append(warnings, normalizeAnswers(in.Answers)...)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var c ChecklistDetail
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		upd := in // linking fills in names; start from the request on a retry
+
+		// lock the row so concurrent updates of the same checklist are applied
+		// one after another
+		var (
+			archivedAt, storedDate sql.NullTime
+			owner                  sql.NullInt64
+		)
+		err := tx.QueryRowContext(ctx,
+			`SELECT archived_at, date_of_check, specialist_id FROM checklists WHERE id = $1 AND org_id = $2 FOR UPDATE`,
+			id, orgFrom(ctx)).Scan(&archivedAt, &storedDate, &owner)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newStatusError(http.StatusNotFound, codeNotFound, "checklist not found")
+		}
+		if err != nil {
+			return fmt.Errorf("lock checklist %d: %w", id, err)
+		}
+		if archivedAt.Valid {
+			return newStatusError(http.StatusConflict, codeConflict, "checklist is archived")
+		}
+		// a specialist can neither change someone else's checklist nor hand
+		// their own over to someone else
+		if !canEditChecklist(ctx, int64Ptr(owner)) {
+			return newStatusError(http.StatusForbidden, codeForbidden, errNotOwner.Error())
+		}
+		if err := ownChecklist(ctx, &upd); err != nil {
+			return newStatusError(http.StatusForbidden, codeForbidden, err.Error())
+		}
+
+		checkDate := date
+		if !checkDate.Valid {
+			checkDate = storedDate
+		}
+		if err := linkChecklist(ctx, tx, &upd, checkDate, false); invalidLink(err) {
+			return newStatusError(http.StatusBadRequest, codeBadRequest, err.Error())
+		} else if err != nil {
+			return fmt.Errorf("link checklist %d: %w", id, err)
+		}
+
+		if replace {
+			err = replaceChecklist(ctx, tx, id, upd, date, clientCreatedAt)
+		} else {
+			err = patchChecklist(ctx, tx, id, upd, date, clientCreatedAt)
+		}
+		if err == nil {
+			err = refreshSearchVectors(ctx, tx, id)
+		}
+		if err != nil {
+			return fmt.Errorf("update checklist %d: %w", id, err)
+		}
+
+		if c, err = loadChecklist(ctx, tx, id); err != nil {
+			return fmt.Errorf("load checklist %d: %w", id, err)
+		}
+
+		mode := "patch"
+		if replace {
+			mode = "replace"
+		}
+		return appendEvent(ctx, tx, eventChecklistUpdated, id, map[string]interface{}{"id": id, "mode": mode})
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to update checklist")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"checklist": c, "warnings": nonNilWarnings(warnings)}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// replaceChecklist overwrites the metadata of checklist id, including the
+// child and specialist links, and replaces its answers. client_created_at is kept unless a
+// new one is given.
+func replaceChecklist(ctx context.Context, tx *sql.Tx, id int64, in Checklist, date, clientCreatedAt sql.NullTime) error {
+	_, err := tx.ExecContext(ctx,
+		`UPDATE checklists SET child_name = $2, date_of_check = $3, specialist = $4,
+           client_created_at = COALESCE($5, client_created_at), child_id = $6, specialist_id = $7, updated_at = now()
+         WHERE id = $1`,
+		id, nullStringPtr(in.ChildName), nullTime(date), nullStringPtr(in.Specialist), nullTime(clientCreatedAt),
+		in.ChildID, in.SpecialistID)
+	if err != nil {
+		return fmt.Errorf("update checklist: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM answers WHERE checklist_id = $1`, id); err != nil {
+		return fmt.Errorf("delete answers: %w", err)
+	}
+	return insertAnswers(ctx, tx, id, in.Answers)
+}
+
+// patchChecklist updates the metadata fields present in the body and merges
+// the given answers into checklist id.
+func patchChecklist(ctx context.Context, tx *sql.Tx, id int64, in Checklist, date, clientCreatedAt sql.NullTime) error {
+	sets := []string{"updated_at = now()"}
+	args := []interface{}{id}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	if in.ChildName != nil {
+		set("child_name", nullStringPtr(in.ChildName))
+	}
+	if in.ChildID != nil {
+		set("child_id", *in.ChildID)
+	}
+	if in.SpecialistID != nil {
+		set("specialist_id", *in.SpecialistID)
+	}
+	if date.Valid {
+		set("date_of_check", date.Time)
+	}
+	if in.Specialist != nil {
+		set("specialist", nullStringPtr(in.Specialist))
+	}
+	if clientCreatedAt.Valid {
+		set("client_created_at", clientCreatedAt.Time)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE checklists SET `+strings.Join(sets, ", ")+` WHERE id = $1`, args...); err != nil {
+		return fmt.Errorf("update checklist: %w", err)
+	}
+
+	var added []Answer
+	for _, a := range in.Answers {
+		res, err := tx.ExecContext(ctx,
+			`UPDATE answers SET label = COALESCE(NULLIF($3, ''), label), value = $4, comment = $5
+             WHERE checklist_id = $1 AND key_name = $2`,
+			id, a.Key, a.Label, a.Value, a.Comment)
+		if err != nil {
+			return fmt.Errorf("update answer %q: %w", a.Key, err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			added = append(added, a)
+		}
+	}
+	return insertAnswers(ctx, tx, id, added)
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// loadChecklist reads a checklist and its answers; it returns sql.ErrNoRows
+// for an unknown id or a checklist of another organization.
+func loadChecklist(ctx context.Context, q queryer, id int64) (ChecklistDetail, error) {
+	var (
+		c                                     = ChecklistDetail{ID: id}
+		child, spc                            sql.NullString
+		date, client, recv, updated, archived sql.NullTime
+		mergedInto, childID, specialistID     sql.NullInt64
+		clientUUID                            sql.NullString
+		createdAt                             time.Time
+	)
+	err := q.QueryRowContext(ctx,
+		`SELECT child_name, date_of_check, specialist, created_at, client_created_at, server_received_at, updated_at,
+                archived_at, merged_into, client_uuid, child_id, specialist_id
+         FROM checklists WHERE id = $1 AND org_id = $2`, id, orgFrom(ctx)).Scan(&child, &date, &spc, &createdAt, &client, &recv, &updated,
+		&archived, &mergedInto, &clientUUID, &childID, &specialistID)
+	if err != nil {
+		return c, err
+	}
+	created := createdAt.UTC().Format(time.RFC3339)
+	c.ChildName, c.Date, c.Specialist, c.CreatedAt = stringPtr(child), datePtr(date), stringPtr(spc), &created
+	c.ClientCreatedAt, c.ServerReceivedAt, c.UpdatedAt = timePtr(client), timePtr(recv), timePtr(updated)
+	c.ArchivedAt, c.ClientUUID = timePtr(archived), stringPtr(clientUUID)
+	if mergedInto.Valid {
+		c.MergedInto = &mergedInto.Int64
+	}
+	if childID.Valid {
+		c.ChildID = &childID.Int64
+	}
+	if specialistID.Valid {
+		c.SpecialistID = &specialistID.Int64
+	}
+
+	rows, err := q.QueryContext(ctx,
+		`SELECT key_name, COALESCE(label, ''), value, comment FROM answers WHERE checklist_id = $1 ORDER BY id`, id)
+	if err != nil {
+		return c, err
+	}
+	defer rows.Close()
+
+	c.Answers = []Answer{}
+	for rows.Next() {
+		var (
+			a              Answer
+			value, comment sql.NullString
+		)
+		if err := rows.Scan(&a.Key, &a.Label, &value, &comment); err != nil {
+			return c, err
+		}
+		a.Value, a.Comment = stringPtr(value), stringPtr(comment)
+		c.Answers = append(c.Answers, a)
+	}
+	return c, rows.Err()
+}
+
+// scanChecklistSummaries reads rows selected with checklistSummaryColumns.
+func scanChecklistSummaries(rows *sql.Rows) ([]ChecklistSummary, error) {
+	items := []ChecklistSummary{}
+	for rows.Next() {
+		var (
+			s                  ChecklistSummary
+			childID, spcID     sql.NullInt64
+			child, spc         sql.NullString
+			date, client, recv sql.NullTime
+		)
+		if err := rows.Scan(&s.ID, &childID, &child, &date, &spcID, &spc, &client, &recv, &s.AnswerCount); err != nil {
+			return nil, err
+		}
+		s.ChildName, s.Date, s.Specialist = stringPtr(child), datePtr(date), stringPtr(spc)
+		s.ClientCreatedAt, s.ServerReceivedAt = timePtr(client), timePtr(recv)
+		if childID.Valid {
+			s.ChildID = &childID.Int64
+		}
+		if spcID.Valid {
+			s.SpecialistID = &spcID.Int64
+		}
+		items = append(items, s)
+	}
+	return items, rows.Err()
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Child is a child examined with checklists.
+type Child struct {
+	ID             int64      `json:"id"`
+	Name           string     `json:"name"`
+	BirthDate      *string    `json:"birthDate"`
+	Group          *string    `json:"group"`
+	ExternalID     *string    `json:"externalId"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	UpdatedAt      *time.Time `json:"updatedAt"`
+	ChecklistCount int        `json:"checklistCount"`
+}
+
+type childInput struct {
+	Name       string  `json:"name"`
+	BirthDate  *string `json:"birthDate"` // YYYY-MM-DD
+	Group      *string `json:"group"`
+	ExternalID *string `json:"externalId"`
+}
+
+// childColumns selects a Child from children aliased as ch.
+const childColumns = `ch.id, ch.name, ch.birth_date, ch.group_name, ch.external_id, ch.created_at, ch.updated_at,
+  (SELECT count(*) FROM checklists c WHERE c.child_id = ch.id AND c.archived_at IS NULL)`
+
+var (
+	// errUnknownChild and errCheckBeforeBirth are returned by linkChild; the
+	// transaction stays usable.
+	errUnknownChild     = errors.New("unknown childId")
+	errCheckBeforeBirth = errors.New("date is before the child's birth date")
+
+	errExternalIDExists = errors.New("externalId already exists")
+)
+
+// childrenHandler handles GET (search) and POST (create) on /api/children
+func childrenHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listChildren(w, r)
+	case http.MethodPost:
+		createChild(w, r)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// listChildren returns children ordered by name, optionally filtered with ?q=
+// (part of the name, or the exact external ID), ?group= (case-insensitive
+// exact match) and paged with ?limit=&offset=.
+func listChildren(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, offset := defaultPageLimit, 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "limit must be between 1 and 200")
+			return
+		}
+		limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "offset must be a non-negative integer")
+			return
+		}
+		offset = n
+	}
+
+	var (
+		conds = []string{"ch.org_id = $1"}
+		args  = []interface{}{orgFrom(r.Context())}
+	)
+	if v := strings.TrimSpace(q.Get("q")); v != "" {
+		args = append(args, v)
+		conds = append(conds, fmt.Sprintf(`(ch.name ILIKE '%%' || $%[1]d || '%%' OR ch.external_id = $%[1]d)`, len(args)))
+	}
+	if v := strings.TrimSpace(q.Get("group")); v != "" {
+		args = append(args, v)
+		conds = append(conds, fmt.Sprintf(`lower(ch.group_name) = lower($%d)`, len(args)))
+	}
+	where := "\nWHERE " + strings.Join(conds, " AND ")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var (
+		total int64
+		items []Child
+	)
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, `SELECT count(*) FROM children ch`+where, args...).Scan(&total); err != nil {
+			return fmt.Errorf("count children: %w", err)
+		}
+
+		n := len(args)
+		rows, err := tx.QueryContext(ctx, `SELECT `+childColumns+` FROM children ch`+where+`
+ORDER BY lower(ch.name), ch.id`+fmt.Sprintf(` LIMIT $%d OFFSET $%d`, n+1, n+2), append(args, limit, offset)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		items = []Child{}
+		for rows.Next() {
+			c, err := scanChild(rows)
+			if err != nil {
+				return err
+			}
+			items = append(items, c)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list children")
+		log.Printf("list children error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	resp := map[string]interface{}{"items": items, "limit": limit, "offset": offset, "total": total}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func createChild(w http.ResponseWriter, r *http.Request) {
+	var in childInput
+	warnings, err := decodeJSON(r.Body, &in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	birth, err := validateChildInput(&in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var (
+		id int64
+		c  Child
+	)
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx,
+			`INSERT INTO children (name, birth_date, group_name, external_id, org_id) VALUES ($1, $2, $3, $4, $5)
+             ON CONFLICT (org_id, external_id) DO NOTHING
+             RETURNING id`,
+			in.Name, nullTime(birth), nullStringPtr(in.Group), nullStringPtr(in.ExternalID), orgFrom(ctx)).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newStatusError(http.StatusConflict, codeConflict, errExternalIDExists.Error())
+		}
+		if err != nil {
+			return fmt.Errorf("insert child: %w", err)
+		}
+		if c, err = loadChild(ctx, tx, id); err != nil {
+			return fmt.Errorf("load child %d: %w", id, err)
+		}
+		return appendEvent(ctx, tx, eventChildCreated, id, map[string]interface{}{"id": id})
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to insert child")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/api/children/%d", id))
+	w.WriteHeader(http.StatusCreated)
+	resp := map[string]interface{}{"child": c, "warnings": nonNilWarnings(warnings)}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// childHandler handles GET, PUT (replace) and DELETE on /api/children/{id}.
+func childHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid child id")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		var c Child
+		err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+			var err error
+			c, err = loadChild(ctx, tx, id)
+			return err
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "child not found")
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load child")
+			log.Printf("load child %d error: %v", id, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(c)
+	case http.MethodPut:
+		updateChild(ctx, w, r, id)
+	case http.MethodDelete:
+		deleteChild(ctx, w, r, id)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// updateChild replaces the fields of child id. The name stored on already
+// linked checklists is what was entered at the examination and is kept.
+func updateChild(ctx context.Context, w http.ResponseWriter, r *http.Request, id int64) {
+	var in childInput
+	warnings, err := decodeJSON(r.Body, &in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	birth, err := validateChildInput(&in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	var c Child
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx,
+			`UPDATE children SET name = $2, birth_date = $3, group_name = $4, external_id = $5, updated_at = now()
+             WHERE id = $1 AND org_id = $6`,
+			id, in.Name, nullTime(birth), nullStringPtr(in.Group), nullStringPtr(in.ExternalID), orgFrom(ctx))
+		if isUniqueViolation(err) {
+			return newStatusError(http.StatusConflict, codeConflict, errExternalIDExists.Error())
+		}
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return newStatusError(http.StatusNotFound, codeNotFound, "child not found")
+		}
+		if c, err = loadChild(ctx, tx, id); err != nil {
+			return fmt.Errorf("load child %d: %w", id, err)
+		}
+		return appendEvent(ctx, tx, eventChildUpdated, id, map[string]interface{}{"id": id})
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to update child")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"child": c, "warnings": nonNilWarnings(warnings)}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// deleteChild removes a child that no checklist refers to.
+func deleteChild(ctx context.Context, w http.ResponseWriter, r *http.Request, id int64) {
+	err := inTx(ctx, nil, func(tx *sql.Tx) error {
+		var linked bool
+		err := tx.QueryRowContext(ctx,
+			`SELECT EXISTS (SELECT 1 FROM checklists WHERE child_id = ch.id) FROM children ch
+             WHERE ch.id = $1 AND ch.org_id = $2 FOR UPDATE`,
+			id, orgFrom(ctx)).Scan(&linked)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newStatusError(http.StatusNotFound, codeNotFound, "child not found")
+		}
+		if err != nil {
+			return fmt.Errorf("lock child %d: %w", id, err)
+		}
+		if linked {
+			return newStatusError(http.StatusConflict, codeConflict, "child has checklists")
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM children WHERE id = $1`, id); err != nil {
+			return err
+		}
+		return appendEvent(ctx, tx, eventChildDeleted, id, map[string]interface{}{"id": id})
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to delete child")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// childChecklistsHandler handles GET /api/children/{id}/checklists: the
+// checklists linked to the child, with the paging and filters of
+// GET /api/checklist.
+func childChecklistsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid child id")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var exists bool
+	err = inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM children WHERE id = $1 AND org_id = $2)`,
+			id, orgFrom(ctx)).Scan(&exists)
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load child")
+		log.Printf("load child %d error: %v", id, err)
+		return
+	}
+	if !exists {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "child not found")
+		return
+	}
+
+	q := r.URL.Query()
+	q.Set("child_id", strconv.FormatInt(id, 10))
+	r2 := r.Clone(r.Context())
+	r2.URL.RawQuery = q.Encode()
+	listChecklists(w, r2)
+}
+
+// validateChildInput trims the fields of in and parses the birth date.
+func validateChildInput(in *childInput) (sql.NullTime, error) {
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" {
+		return sql.NullTime{}, errors.New("name must be provided")
+	}
+	var birth sql.NullTime
+	if in.BirthDate != nil && strings.TrimSpace(*in.BirthDate) != "" {
+		t, err := time.Parse("2006-01-02", strings.TrimSpace(*in.BirthDate))
+		if err != nil {
+			return birth, errors.New("birthDate must be YYYY-MM-DD")
+		}
+		if t.After(time.Now()) {
+			return birth, errors.New("birthDate must not be in the future")
+		}
+		birth = sql.NullTime{Time: t, Valid: true}
+	}
+	return birth, nil
+}
+
+// linkChild resolves c.ChildID, when set, to a child of the organization of
+// ctx and copies the child's name into c.ChildName so that the name-based
+// search and statistics keep working for linked checklists. date is the
+// examination date, checked against the birth date.
+func linkChild(ctx context.Context, q queryer, c *Checklist, date sql.NullTime) error {
+	if c.ChildID == nil {
+		return nil
+	}
+	var (
+		name  string
+		birth sql.NullTime
+	)
+	err := q.QueryRowContext(ctx, `SELECT name, birth_date FROM children WHERE id = $1 AND org_id = $2`,
+		*c.ChildID, orgFrom(ctx)).Scan(&name, &birth)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errUnknownChild
+	}
+	if err != nil {
+		return fmt.Errorf("load child: %w", err)
+	}
+	if date.Valid && birth.Valid && date.Time.Before(birth.Time) {
+		return errCheckBeforeBirth
+	}
+	c.ChildName = &name
+	return nil
+}
+
+func loadChild(ctx context.Context, q queryer, id int64) (Child, error) {
+	return scanChild(q.QueryRowContext(ctx, `SELECT `+childColumns+` FROM children ch WHERE ch.id = $1 AND ch.org_id = $2`,
+		id, orgFrom(ctx)))
+}
+
+func scanChild(row rowScanner) (Child, error) {
+	var (
+		c            Child
+		birth        sql.NullTime
+		group, extID sql.NullString
+		updated      sql.NullTime
+	)
+	if err := row.Scan(&c.ID, &c.Name, &birth, &group, &extID, &c.CreatedAt, &updated, &c.ChecklistCount); err != nil {
+		return c, err
+	}
+	c.BirthDate, c.Group, c.ExternalID, c.UpdatedAt = datePtr(birth), stringPtr(group), stringPtr(extID), timePtr(updated)
+	return c, nil
+}
+
+// isUniqueViolation reports whether err is a PostgreSQL unique_violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
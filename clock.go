@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Bounds for client-supplied timestamps. Offline clients may push old
+// records, but a clock far in the future or years behind is a bug.
+const (
+	maxClientClockAhead = time.Hour
+	maxClientClockAge   = 366 * 24 * time.Hour
+)
+
+// checkClientClock rejects client timestamps with an implausible skew.
+func checkClientClock(t, now time.Time) error {
+	if t.After(now.Add(maxClientClockAhead)) {
+		return fmt.Errorf("createdAt %s is ahead of server time %s", t.Format(time.RFC3339), now.Format(time.RFC3339))
+	}
+	if t.Before(now.Add(-maxClientClockAge)) {
+		return fmt.Errorf("createdAt %s is more than a year before server time %s", t.Format(time.RFC3339), now.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// timeHandler handles GET /api/time[?client_time=RFC3339]. It returns the
+// server time and, when the client sends its own clock, the skew in
+// milliseconds (positive when the client is ahead), so offline clients can
+// correct queued timestamps before pushing them.
+func timeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	now := time.Now().UTC()
+	resp := map[string]interface{}{
+		"serverTime":        now,
+		"maxClientAheadSec": int(maxClientClockAhead / time.Second),
+		"maxClientAgeSec":   int(maxClientClockAge / time.Second),
+	}
+
+	if v := r.URL.Query().Get("client_time"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "client_time must be RFC3339")
+			return
+		}
+		resp["clientTime"] = t
+		resp["skewMs"] = t.Sub(now).Milliseconds()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(resp)
+}
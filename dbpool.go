@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// rotatingConnector opens connections with the current DSN. Setting a new
+// DSN starts a new generation: connections of older generations finish
+// what they are doing and are then closed by the pool instead of being
+// reused, so credentials can be rotated without a restart.
+type rotatingConnector struct {
+	mu  sync.RWMutex
+	dsn string
+	gen atomic.Uint64
+}
+
+func newRotatingConnector(dsn string) *rotatingConnector {
+	return &rotatingConnector{dsn: dsn}
+}
+
+func (c *rotatingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.RLock()
+	dsn, gen := c.dsn, c.gen.Load()
+	c.mu.RUnlock()
+	cn, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := cn.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if pc, ok := conn.(pqConn); ok {
+		return &generationConn{pqConn: pc, gen: gen, connector: c}, nil
+	}
+	return conn, nil
+}
+
+func (c *rotatingConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// current returns the DSN in use.
+func (c *rotatingConnector) current() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.dsn
+}
+
+// set switches to dsn after checking that a connection can be opened with
+// it; on failure the current DSN is kept.
+func (c *rotatingConnector) set(ctx context.Context, dsn string) error {
+	cn, err := pq.NewConnector(dsn)
+	if err != nil {
+		return err
+	}
+	conn, err := cn.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	_ = conn.Close()
+
+	c.mu.Lock()
+	c.dsn = dsn
+	c.gen.Add(1)
+	c.mu.Unlock()
+	return nil
+}
+
+// pqConn is the set of driver interfaces implemented by lib/pq connections
+// that database/sql makes use of.
+type pqConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.QueryerContext
+	driver.ExecerContext
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+// generationConn is a connection that stops being valid once the connector
+// has moved on to new credentials.
+type generationConn struct {
+	pqConn
+	gen       uint64
+	connector *rotatingConnector
+}
+
+// IsValid is checked by database/sql before a connection is reused and when
+// it is returned to the pool.
+func (c *generationConn) IsValid() bool {
+	return c.gen == c.connector.gen.Load() && c.pqConn.IsValid()
+}
+
+// watchCredentialReload calls reload on every SIGHUP.
+func watchCredentialReload(reload func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			log.Printf("SIGHUP received, reloading database credentials")
+			reload()
+		}
+	}()
+}
+
+// reloadDSN re-reads PG_DSN (or PG_DSN_FILE) and switches the pool to it
+// when it changed.
+func reloadDSN(connector *rotatingConnector) {
+	dsn, err := readSecretEnv("PG_DSN")
+	if err != nil || dsn == "" {
+		log.Printf("database credentials not reloaded: PG_DSN is not available: %v", err)
+		return
+	}
+	if dsn == connector.current() {
+		log.Printf("database credentials unchanged")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := connector.set(ctx, dsn); err != nil {
+		log.Printf("database credentials not reloaded, keeping the current ones: %v", err)
+		return
+	}
+	log.Printf("database credentials reloaded; existing connections are drained")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime/debug"
+)
+
+// startDebugServer serves pprof, expvar and heap dumps on DEBUG_ADDR. There is
+// no authentication on these endpoints, so the address must be a loopback
+// one (e.g. 127.0.0.1:6060); reach it with port forwarding or docker exec.
+func startDebugServer() {
+	addr := os.Getenv("DEBUG_ADDR")
+	if addr == "" {
+		return
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatalf("invalid DEBUG_ADDR %q: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		log.Fatalf("DEBUG_ADDR must be a loopback address, got %q", addr)
+	}
+
+	if db != nil {
+		expvar.Publish("db", expvar.Func(func() interface{} { return db.Stats() }))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/heapdump", heapDumpHandler)
+
+	go func() {
+		log.Printf("debug server listening on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("debug server error: %v", err)
+		}
+	}()
+}
+
+// heapDumpHandler handles POST /debug/heapdump: it writes a full heap dump
+// (runtime/debug.WriteHeapDump) to DEBUG_DUMP_DIR, or the temp dir, and
+// returns the file path. The dump stops the world while it is written.
+func heapDumpHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	f, err := os.CreateTemp(os.Getenv("DEBUG_DUMP_DIR"), "heapdump-*.bin")
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to create dump file")
+		log.Printf("create heap dump error: %v", err)
+		return
+	}
+	debug.WriteHeapDump(f.Fd())
+	if err := f.Close(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to write dump file")
+		log.Printf("close heap dump error: %v", err)
+		return
+	}
+
+	log.Printf("heap dump written to %s", f.Name())
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"path": f.Name()})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// unknownFieldsMode controls how request bodies with unknown JSON fields are
+// handled.
+type unknownFieldsMode int
+
+const (
+	unknownFieldsReject unknownFieldsMode = iota // 400 Bad Request
+	unknownFieldsWarn                            // accept, log and report a warning
+	unknownFieldsIgnore                          // accept silently
+)
+
+var unknownFields = unknownFieldsReject
+
+// configureJSONDecoding reads JSON_UNKNOWN_FIELDS (reject, warn or ignore).
+func configureJSONDecoding() {
+	switch v := os.Getenv("JSON_UNKNOWN_FIELDS"); v {
+	case "", "reject":
+		unknownFields = unknownFieldsReject
+	case "warn":
+		unknownFields = unknownFieldsWarn
+	case "ignore":
+		unknownFields = unknownFieldsIgnore
+	default:
+		log.Fatalf("JSON_UNKNOWN_FIELDS must be reject, warn or ignore, got %q", v)
+	}
+}
+
+// decodeJSON decodes a request body into v according to the unknown fields
+// mode. In warn mode it returns one warning per unknown field.
+func decodeJSON(r io.Reader, v interface{}) ([]string, error) {
+	if unknownFields == unknownFieldsReject {
+		dec := json.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		return nil, dec.Decode(v)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	if unknownFields == unknownFieldsIgnore {
+		return nil, nil
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	var fields []string
+	collectUnknownFields(raw, reflect.TypeOf(v), "", &fields)
+
+	var warnings []string
+	for _, f := range fields {
+		log.Printf("unknown json field ignored: %s", f)
+		warnings = append(warnings, fmt.Sprintf("unknown field %q ignored", f))
+	}
+	return warnings, nil
+}
+
+// collectUnknownFields walks decoded JSON alongside the target type and
+// records the paths of object keys that have no matching struct field.
+func collectUnknownFields(raw interface{}, t reflect.Type, path string, out *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch val := raw.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct {
+			return
+		}
+		fields := jsonFieldTypes(t)
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			// encoding/json matches keys to fields case-insensitively
+			ft, ok := fields[strings.ToLower(k)]
+			if !ok {
+				*out = append(*out, p)
+				continue
+			}
+			collectUnknownFields(val[k], ft, p, out)
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return
+		}
+		for i, e := range val {
+			collectUnknownFields(e, t.Elem(), fmt.Sprintf("%s[%d]", path, i), out)
+		}
+	}
+}
+
+// jsonFieldTypes maps lower-cased JSON field names of a struct to their types.
+func jsonFieldTypes(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+	return fields
+}
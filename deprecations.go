@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Deprecation announces an endpoint or response field that will be removed.
+// Responses of deprecated endpoints carry Deprecation (RFC 9745) and, once a
+// date is set, Sunset (RFC 8594) headers.
+type Deprecation struct {
+	Type         string     `json:"type"` // endpoint or field
+	Method       string     `json:"method,omitempty"`
+	Path         string     `json:"path"` // route pattern
+	Field        string     `json:"field,omitempty"`
+	DeprecatedAt time.Time  `json:"deprecatedAt"`
+	Sunset       *time.Time `json:"sunset"` // null until a removal date is set
+	Replacement  string     `json:"replacement,omitempty"`
+	Note         string     `json:"note"`
+}
+
+// deprecations is the changelog served by GET /api/meta/deprecations. Add an
+// entry before changing or removing anything integrators may rely on.
+var deprecations = []Deprecation{
+	{
+		Type:         "field",
+		Method:       http.MethodGet,
+		Path:         "/api/checklist/{id}",
+		Field:        "createdAt",
+		DeprecatedAt: time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC),
+		Replacement:  "clientCreatedAt, serverReceivedAt",
+		Note:         "holds the client time when one was sent and the server time otherwise; use clientCreatedAt and serverReceivedAt",
+	},
+}
+
+// deprecationsHandler handles GET /api/meta/deprecations
+func deprecationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"deprecations": deprecations}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// deprecationMiddleware adds the deprecation headers to responses of
+// deprecated endpoints, matched by the mux route pattern.
+func deprecationMiddleware(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		for _, d := range deprecations {
+			if d.Type != "endpoint" || d.Path != pattern || (d.Method != "" && d.Method != r.Method) {
+				continue
+			}
+			h := w.Header()
+			h.Set("Deprecation", fmt.Sprintf("@%d", d.DeprecatedAt.Unix()))
+			if d.Sunset != nil {
+				h.Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+			}
+			h.Add("Link", `</api/meta/deprecations>; rel="deprecation"; type="application/json"`)
+			if d.Replacement != "" {
+				h.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, d.Replacement))
+			}
+			break
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Draft is a checklist being filled in over several sessions. Its checklist
+// is stored as sent, without the validation of POST /api/checklist, and is
+// validated when the draft is finalized. Drafts belong to the specialist who
+// started them.
+type Draft struct {
+	ID           int64     `json:"id"`
+	Checklist    Checklist `json:"checklist"`
+	SpecialistID *int64    `json:"specialistId"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+const draftColumns = `id, data, specialist_id, created_at, updated_at`
+
+// draftsHandler handles GET (list) and POST (create) on /api/checklist/drafts.
+func draftsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listDrafts(w, r)
+	case http.MethodPost:
+		saveDraft(w, r, 0)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// draftHandler handles GET, PATCH (merge) and DELETE on
+// /api/checklist/drafts/{id}.
+func draftHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid draft id")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		getDraft(w, r, id)
+	case http.MethodPatch:
+		saveDraft(w, r, id)
+	case http.MethodDelete:
+		deleteDraft(w, r, id)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// listDrafts returns the drafts of the caller, all drafts of the
+// organization for admins, most recently changed first.
+func listDrafts(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + draftColumns + ` FROM checklist_drafts WHERE org_id = $1`
+	args := []interface{}{orgFrom(ctx)}
+	if !isAdmin(ctx) {
+		query += ` AND specialist_id = $2`
+		args = append(args, authFrom(ctx).SpecialistID())
+	}
+	query += ` ORDER BY updated_at DESC, id DESC`
+
+	var items []Draft
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		items = []Draft{}
+		for rows.Next() {
+			d, err := scanDraft(rows)
+			if err != nil {
+				return err
+			}
+			items = append(items, d)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list drafts")
+		log.Printf("list drafts error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+}
+
+func getDraft(w http.ResponseWriter, r *http.Request, id int64) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var d Draft
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		var err error
+		d, err = loadDraft(ctx, tx, id, false)
+		return err
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to load draft")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(d)
+}
+
+// saveDraft creates a draft (id == 0) or merges the body into an existing
+// one: the fields present in the body replace the stored ones and answers
+// are merged by key, as PATCH /api/checklist/{id} does.
+func saveDraft(w http.ResponseWriter, r *http.Request, id int64) {
+	var in Checklist
+	warnings, err := decodeJSON(r.Body, &in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	status := http.StatusCreated
+	if id != 0 {
+		status = http.StatusOK
+	}
+	var d Draft
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		if id == 0 {
+			var owner *int64
+			if c := authFrom(ctx); c != nil {
+				self := c.SpecialistID()
+				owner = &self
+			}
+			data, err := json.Marshal(in)
+			if err != nil {
+				return err
+			}
+			d, err = scanDraft(tx.QueryRowContext(ctx,
+				`INSERT INTO checklist_drafts (org_id, specialist_id, data) VALUES ($1, $2, $3) RETURNING `+draftColumns,
+				orgFrom(ctx), owner, string(data)))
+			return err
+		}
+
+		var err error
+		if d, err = loadDraft(ctx, tx, id, true); err != nil {
+			return err
+		}
+		mergeDraft(&d.Checklist, in)
+		data, err := json.Marshal(d.Checklist)
+		if err != nil {
+			return err
+		}
+		d, err = scanDraft(tx.QueryRowContext(ctx,
+			`UPDATE checklist_drafts SET data = $2, updated_at = now() WHERE id = $1 RETURNING `+draftColumns,
+			id, string(data)))
+		return err
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to save draft")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	resp := struct {
+		Draft
+		Warnings []string `json:"warnings"`
+	}{d, nonNilWarnings(warnings)}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func deleteDraft(w http.ResponseWriter, r *http.Request, id int64) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	err := inTx(ctx, nil, func(tx *sql.Tx) error {
+		if _, err := loadDraft(ctx, tx, id, true); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM checklist_drafts WHERE id = $1`, id)
+		return err
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to delete draft")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finalizeDraftHandler handles POST /api/checklist/drafts/{id}/finalize. The
+// draft is validated and saved like a POST /api/checklist, and is deleted in
+// the same transaction. The response and on_duplicate are those of POST
+// /api/checklist.
+func finalizeDraftHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid draft id")
+		return
+	}
+	onDuplicate, err := parseOnDuplicate(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var (
+		code int
+		resp map[string]interface{}
+	)
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		d, err := loadDraft(ctx, tx, id, true)
+		if err != nil {
+			return err
+		}
+		nc, warnings, err := prepareNewChecklist(d.Checklist, time.Now().UTC(), false)
+		if err != nil {
+			return newStatusError(http.StatusBadRequest, codeBadRequest, err.Error())
+		}
+		if err := ownChecklist(ctx, &nc.Checklist); err != nil {
+			return newStatusError(http.StatusForbidden, codeForbidden, err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM checklist_drafts WHERE id = $1`, id); err != nil {
+			return fmt.Errorf("delete draft %d: %w", id, err)
+		}
+
+		checklistID, status, err := saveChecklist(ctx, tx, nc, onDuplicate)
+		var dup *duplicateChecklistError
+		switch {
+		case errors.As(err, &dup):
+			return dup.statusError()
+		case errors.Is(err, errChecklistArchived):
+			return newStatusError(http.StatusConflict, codeConflict, "checklist is archived")
+		case errors.Is(err, errNotOwner):
+			return newStatusError(http.StatusForbidden, codeForbidden, err.Error())
+		case invalidLink(err):
+			return newStatusError(http.StatusBadRequest, codeBadRequest, err.Error())
+		case err != nil:
+			return err
+		}
+		if status == saveUnchanged {
+			warnings = append(warnings, "a newer version of this checklist is already stored")
+		}
+		code = http.StatusOK
+		if status == saveCreated {
+			code = http.StatusCreated
+		}
+		resp = map[string]interface{}{
+			"id":               checklistID,
+			"status":           status,
+			"clientCreatedAt":  timePtr(nc.clientCreatedAt),
+			"serverReceivedAt": nc.receivedAt,
+			"warnings":         nonNilWarnings(warnings),
+		}
+		return nil
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to finalize draft")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// loadDraft loads draft id of the organization of ctx, locking it for the
+// transaction when forUpdate is set. A draft of someone else is reported as
+// not found.
+func loadDraft(ctx context.Context, q queryer, id int64, forUpdate bool) (Draft, error) {
+	query := `SELECT ` + draftColumns + ` FROM checklist_drafts WHERE id = $1 AND org_id = $2`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+	d, err := scanDraft(q.QueryRowContext(ctx, query, id, orgFrom(ctx)))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !canEditChecklist(ctx, d.SpecialistID)) {
+		return d, newStatusError(http.StatusNotFound, codeNotFound, "draft not found")
+	}
+	if err != nil {
+		return d, fmt.Errorf("load draft %d: %w", id, err)
+	}
+	return d, nil
+}
+
+// mergeDraft applies the fields present in in to c and merges its answers by
+// key: a known key gets the new label (when not empty), value and comment, an
+// unknown key is added.
+func mergeDraft(c *Checklist, in Checklist) {
+	if in.ChildName != nil {
+		c.ChildName = in.ChildName
+	}
+	if in.ChildID != nil {
+		c.ChildID = in.ChildID
+	}
+	if in.Date != nil {
+		c.Date = in.Date
+	}
+	if in.Specialist != nil {
+		c.Specialist = in.Specialist
+	}
+	if in.SpecialistID != nil {
+		c.SpecialistID = in.SpecialistID
+	}
+	if in.CreatedAt != nil {
+		c.CreatedAt = in.CreatedAt
+	}
+	if in.ClientUUID != nil {
+		c.ClientUUID = in.ClientUUID
+	}
+	for _, a := range in.Answers {
+		i := 0
+		for i < len(c.Answers) && c.Answers[i].Key != a.Key {
+			i++
+		}
+		if i == len(c.Answers) {
+			c.Answers = append(c.Answers, a)
+			continue
+		}
+		if a.Label != "" {
+			c.Answers[i].Label = a.Label
+		}
+		c.Answers[i].Value, c.Answers[i].Comment = a.Value, a.Comment
+	}
+}
+
+func scanDraft(row rowScanner) (Draft, error) {
+	var (
+		d     Draft
+		data  []byte
+		owner sql.NullInt64
+	)
+	if err := row.Scan(&d.ID, &data, &owner, &d.CreatedAt, &d.UpdatedAt); err != nil {
+		return d, err
+	}
+	d.SpecialistID = int64Ptr(owner)
+	return d, json.Unmarshal(data, &d.Checklist)
+}
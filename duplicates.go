@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// What to do when a new checklist duplicates a stored one (on_duplicate).
+const (
+	duplicateReject = "reject" // 409 with the id of the stored checklist
+	duplicateMerge  = "merge"  // merge the new checklist into the stored one
+	duplicateCreate = "create" // store it anyway, e.g. a second examination on the same day
+)
+
+// saveMerged is the outcome of saveChecklist when the checklist was merged
+// into a duplicate.
+const saveMerged = "merged"
+
+// duplicateChecklistError is returned by saveChecklist when a checklist for
+// the same child, date and specialist is already stored.
+type duplicateChecklistError struct {
+	id int64
+}
+
+func (e *duplicateChecklistError) Error() string {
+	return "a checklist for this child, date and specialist already exists"
+}
+
+// statusError turns e into a 409 carrying the id of the stored checklist.
+func (e *duplicateChecklistError) statusError() error {
+	return &statusError{status: http.StatusConflict, code: codeConflict, message: e.Error(),
+		details: map[string]interface{}{"existingId": e.id}}
+}
+
+// parseOnDuplicate reads the on_duplicate query parameter.
+func parseOnDuplicate(r *http.Request) (string, error) {
+	switch v := r.URL.Query().Get("on_duplicate"); v {
+	case "":
+		return duplicateReject, nil
+	case duplicateReject, duplicateMerge, duplicateCreate:
+		return v, nil
+	default:
+		return "", fmt.Errorf("on_duplicate must be %s, %s or %s", duplicateReject, duplicateMerge, duplicateCreate)
+	}
+}
+
+// findDuplicateChecklist returns the id of a stored checklist, not archived,
+// of the organization of ctx with the date, child and specialist of nc, or 0.
+// A linked child matches by id only; the name, ignoring case, is compared
+// only when neither checklist has a child id. The specialist matches by id
+// or by name. A checklist naming no child is never a duplicate. Creations
+// of checklists for the same date are serialized with a transaction-scoped
+// advisory lock, so two submissions sent at once cannot both miss each other.
+func findDuplicateChecklist(ctx context.Context, tx *sql.Tx, nc newChecklist) (int64, error) {
+	if (nc.ChildID == nil && nc.ChildName == nil) || !nc.date.Valid {
+		return 0, nil
+	}
+	org, date := orgFrom(ctx), nc.date.Time.Format(time.DateOnly)
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`,
+		fmt.Sprintf("checklist:%d:%s", org, date)); err != nil {
+		return 0, fmt.Errorf("lock checklist date: %w", err)
+	}
+
+	var id int64
+	err := tx.QueryRowContext(ctx,
+		`SELECT c.id FROM checklists c
+         WHERE c.org_id = $1 AND c.date_of_check = $2::date AND c.archived_at IS NULL
+           AND (c.child_id = $3 OR ($3::bigint IS NULL AND c.child_id IS NULL
+                AND lower(btrim(c.child_name)) = lower(btrim($4::text))))
+           AND (c.specialist_id = $5 OR lower(btrim(c.specialist)) = lower(btrim($6::text))
+                OR ($5::bigint IS NULL AND $6::text IS NULL AND c.specialist_id IS NULL AND c.specialist IS NULL))
+         ORDER BY c.id LIMIT 1`,
+		org, date, nc.ChildID, nullStringPtr(nc.ChildName), nc.SpecialistID, nullStringPtr(nc.Specialist)).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+// insertImportedChecklist inserts an imported checklist like
+// insertChecklist, unless it duplicates a stored one or one imported earlier
+// in tx. Such a checklist is rejected with a *duplicateChecklistError.
+func insertImportedChecklist(ctx context.Context, tx *sql.Tx, nc newChecklist) (int64, error) {
+	dup, err := findDuplicateChecklist(ctx, tx, nc)
+	if err != nil {
+		return 0, err
+	}
+	if dup != 0 {
+		return 0, &duplicateChecklistError{id: dup}
+	}
+	return insertChecklist(ctx, tx, nc)
+}
+
+// importRejection returns the message recorded for an imported checklist
+// refused by insertImportedChecklist, and false for errors that fail the
+// whole batch.
+func importRejection(err error) (string, bool) {
+	var dup *duplicateChecklistError
+	switch {
+	case errors.As(err, &dup):
+		return fmt.Sprintf("%s (checklist %d)", dup.Error(), dup.id), true
+	case errors.Is(err, errDuplicateClientUUID), invalidLink(err):
+		return err.Error(), true
+	}
+	return "", false
+}
+
+// mergeDuplicate merges nc into the stored checklist id like PATCH
+// /api/checklist/{id}: the fields nc sets replace the stored ones and answers
+// are merged by key.
+func mergeDuplicate(ctx context.Context, tx *sql.Tx, id int64, nc newChecklist) error {
+	var owner sql.NullInt64
+	if err := tx.QueryRowContext(ctx, `SELECT specialist_id FROM checklists WHERE id = $1 FOR UPDATE`, id).Scan(&owner); err != nil {
+		return fmt.Errorf("lock checklist %d: %w", id, err)
+	}
+	if !canEditChecklist(ctx, int64Ptr(owner)) {
+		return errNotOwner
+	}
+	if err := linkChecklist(ctx, tx, &nc.Checklist, nc.date, false); err != nil {
+		return err
+	}
+	if err := patchChecklist(ctx, tx, id, nc.Checklist, nc.date, nc.clientCreatedAt); err != nil {
+		return err
+	}
+	return refreshSearchVectors(ctx, tx, id)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseOnDuplicate(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{"", duplicateReject, false},
+		{"?on_duplicate=reject", duplicateReject, false},
+		{"?on_duplicate=merge", duplicateMerge, false},
+		{"?on_duplicate=create", duplicateCreate, false},
+		{"?on_duplicate=", duplicateReject, false},
+		{"?on_duplicate=Merge", "", true},
+		{"?on_duplicate=skip", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseOnDuplicate(httptest.NewRequest(http.MethodPost, "/api/checklist"+tt.query, nil))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseOnDuplicate(%q) = %q, %v; want %q, error %v", tt.query, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFindDuplicateChecklist(t *testing.T) {
+	testDB(t)
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// the child names are unique, so other stored checklists cannot match
+	date := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	name := uniqueName("Иванов Иван ")
+	linked, namesake := insertChild(t, tx, name), insertChild(t, tx, name)
+	var stored, storedByName int64
+	if err := tx.QueryRow(`INSERT INTO checklists (org_id, child_id, child_name, date_of_check, specialist)
+VALUES ($1, $2, $3, $4, 'Петрова') RETURNING id`, defaultOrgID, linked, name, date).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	unlinked := uniqueName("Петров Пётр ")
+	if err := tx.QueryRow(`INSERT INTO checklists (org_id, child_name, date_of_check, specialist)
+VALUES ($1, $2, $3, 'Петрова') RETURNING id`, defaultOrgID, unlinked, date).Scan(&storedByName); err != nil {
+		t.Fatal(err)
+	}
+	unlinkedChild := insertChild(t, tx, unlinked)
+
+	tests := []struct {
+		name       string
+		childID    *int64
+		childName  string
+		specialist string
+		want       int64
+	}{
+		{"same child id", &linked, name, "Петрова", stored},
+		{"same child id, other specialist", &linked, name, "Сидорова", 0},
+		{"same child id, specialist in other case", &linked, name, " петрова", stored},
+		{"namesake with another id", &namesake, name, "Петрова", 0},
+		{"name of a linked child", nil, name, "Петрова", 0},
+		{"same name, neither linked", nil, " " + unlinked + " ", "Петрова", storedByName},
+		{"linked, stored one not", &unlinkedChild, unlinked, "Петрова", 0},
+	}
+	for _, tt := range tests {
+		nc := newChecklist{Checklist: Checklist{ChildID: tt.childID, ChildName: &tt.childName, Specialist: &tt.specialist},
+			date: sql.NullTime{Time: date, Valid: true}}
+		got, err := findDuplicateChecklist(ctx, tx, nc)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: duplicate = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func insertChild(t *testing.T, tx *sql.Tx, name string) int64 {
+	t.Helper()
+	var id int64
+	if err := tx.QueryRow(`INSERT INTO children (org_id, name) VALUES ($1, $2) RETURNING id`, defaultOrgID, name).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Error codes of the JSON error envelope. Clients should branch on these
+// rather than on the message text.
+const (
+	codeBadRequest       = "bad_request"
+	codeInvalidJSON      = "invalid_json"
+	codeNotFound         = "not_found"
+	codeConflict         = "conflict"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeInternal         = "internal_error"
+	codeUnavailable      = "unavailable"
+)
+
+// problemTypePrefix turns an error code into an RFC 7807 problem type URI.
+const problemTypePrefix = "urn:checklist-tnr:problem:"
+
+// apiError is the body of every error response.
+type apiError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"requestId,omitempty"`
+}
+
+// writeError writes the JSON error envelope.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeErrorDetails(w, r, status, code, message, nil)
+}
+
+// statusError is a client error returned from code that cannot write the
+// response itself, such as an inTx callback.
+type statusError struct {
+	status  int
+	code    string
+	message string
+	details interface{}
+}
+
+func (e *statusError) Error() string { return e.message }
+
+func newStatusError(status int, code, message string) error {
+	return &statusError{status: status, code: code, message: message}
+}
+
+// writeStatusError writes err when it is a statusError. Any other error is
+// answered with 500 and message, and logged.
+func writeStatusError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	var se *statusError
+	if errors.As(err, &se) {
+		writeErrorDetails(w, r, se.status, se.code, se.message, se.details)
+		return
+	}
+	writeError(w, r, http.StatusInternalServerError, codeInternal, message)
+	log.Printf("%s: %v", message, err)
+}
+
+// problemDetails is the RFC 7807 form of apiError, with the envelope fields
+// kept as extension members.
+type problemDetails struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail"`
+	Instance string `json:"instance,omitempty"`
+	apiError
+}
+
+// writeErrorDetails writes the JSON error envelope with machine-readable
+// details, or application/problem+json when the client asks for it.
+func writeErrorDetails(w http.ResponseWriter, r *http.Request, status int, code, message string, details interface{}) {
+	e := apiError{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: requestID(r),
+	}
+	if j := journalFrom(r.Context()); j != nil {
+		j.errCode, j.errMessage = code, message
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if acceptsProblemJSON(r) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(problemDetails{
+			Type:     problemTypePrefix + code,
+			Title:    http.StatusText(status),
+			Status:   status,
+			Detail:   message,
+			Instance: r.URL.Path,
+			apiError: e,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(e)
+}
+
+// acceptsProblemJSON reports whether the Accept header lists
+// application/problem+json.
+func acceptsProblemJSON(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(v, ",") {
+			mediaType, _, _ := strings.Cut(part, ";")
+			if strings.EqualFold(strings.TrimSpace(mediaType), "application/problem+json") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// notFoundHandler answers unknown /api routes with the error envelope.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, codeNotFound, "not found")
+}
+
+type requestIDKey struct{}
+
+// requestIDMiddleware takes the request id from X-Request-ID (as set by a
+// proxy) or generates one, and echoes it in the response header.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			var b [8]byte
+			_, _ = rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the id assigned by requestIDMiddleware, if any.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
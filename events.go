@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxPollWait must stay below the server WriteTimeout.
+	maxPollWait    = 10 * time.Second
+	pollInterval   = 500 * time.Millisecond
+	pollBatchLimit = 100
+	replayBatchMax = 1000
+
+	// eventLogLockID is the advisory lock key serializing event appends.
+	eventLogLockID = 0x6576656e7473 // "events"
+)
+
+// Event types.
+const (
+	eventChecklistCreated      = "checklist.created"
+	eventChecklistUpdated      = "checklist.updated"
+	eventChildCreated          = "child.created"
+	eventChildUpdated          = "child.updated"
+	eventChildDeleted          = "child.deleted"
+	eventSpecialistCreated     = "specialist.created"
+	eventSpecialistUpdated     = "specialist.updated"
+	eventSpecialistDeactivated = "specialist.deactivated"
+	eventGroupCreated          = "group.created"
+	eventGroupDeleted          = "group.deleted"
+)
+
+// Event is a domain event recorded in the events table.
+type Event struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	EntityID  int64           `json:"entityId"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// appendEvent records an event inside the caller's transaction, so the event
+// becomes visible exactly when the change it describes is committed. Appends
+// are serialized with a transaction-scoped advisory lock: event ids are then
+// committed in increasing order and a reader that has seen id N will never
+// later find a new event with a smaller id. Call it as the last statement
+// before Commit to keep the lock short. The event belongs to the
+// organization of ctx.
+func appendEvent(ctx context.Context, tx *sql.Tx, typ string, entityID int64, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, eventLogLockID); err != nil {
+		return err
+	}
+	if e := journalFrom(ctx); e != nil {
+		e.lockWait += time.Since(start)
+		journalTx(ctx, tx, e)
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO events (type, entity_id, payload, org_id) VALUES ($1, $2, $3, NULLIF($4, 0))`,
+		typ, entityID, string(data), orgFrom(ctx))
+	return err
+}
+
+// eventsPollHandler handles GET /api/events/poll?since_id=N&wait=S. It returns
+// events with id > since_id; when there are none it waits up to S seconds for
+// new ones before answering with an empty list.
+func eventsPollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	var sinceID int64
+	if v := q.Get("since_id"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "since_id must be a non-negative integer")
+			return
+		}
+		sinceID = n
+	}
+	var wait time.Duration
+	if v := q.Get("wait"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "wait must be a non-negative number of seconds")
+			return
+		}
+		wait = time.Duration(n) * time.Second
+		if wait > maxPollWait {
+			wait = maxPollWait
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait+5*time.Second)
+	defer cancel()
+
+	deadline := time.Now().Add(wait)
+	var (
+		events []Event
+		err    error
+	)
+	for {
+		events, err = loadEventsSince(ctx, sinceID, pollBatchLimit)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load events")
+			log.Printf("poll events error: %v", err)
+			return
+		}
+		if len(events) > 0 || !time.Now().Add(pollInterval).Before(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+
+	lastID := sinceID
+	if len(events) > 0 {
+		lastID = events[len(events)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"events": events, "lastId": lastID}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// eventsHandler handles GET /api/events?since_id=N&limit=M and returns the
+// event log from a given position without waiting, for replaying history.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	var sinceID int64
+	if v := q.Get("since_id"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "since_id must be a non-negative integer")
+			return
+		}
+		sinceID = n
+	}
+	limit := pollBatchLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > replayBatchMax {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	events, err := loadEventsSince(ctx, sinceID, limit)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load events")
+		log.Printf("load events error: %v", err)
+		return
+	}
+
+	lastID := sinceID
+	if len(events) > 0 {
+		lastID = events[len(events)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"events": events, "lastId": lastID}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// loadEventsSince returns the events of the organization of ctx, and those of
+// the whole installation, after sinceID.
+func loadEventsSince(ctx context.Context, sinceID int64, limit int) ([]Event, error) {
+	var events []Event
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `
+SELECT id, type, entity_id, payload, created_at FROM events
+WHERE id > $1 AND (org_id = $3 OR org_id IS NULL)
+ORDER BY id LIMIT $2`, sinceID, limit, orgFrom(ctx))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		events = []Event{}
+		for rows.Next() {
+			var (
+				e       Event
+				payload []byte
+			)
+			if err := rows.Scan(&e.ID, &e.Type, &e.EntityID, &payload, &e.CreatedAt); err != nil {
+				return err
+			}
+			e.Payload = payload
+			events = append(events, e)
+		}
+		return rows.Err()
+	})
+	return events, err
+}
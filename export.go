@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ndjsonFlushEvery is the number of checklists between flushes of an NDJSON
+// export.
+const ndjsonFlushEvery = 100
+
+// exportColumns are the checklist columns leading every export row.
+var exportColumns = []string{"checklist_id", "child_name", "date", "specialist", "created_at"}
+
+// exportChecklistsHandler handles GET /api/checklist/export?format=&layout=.
+// It streams the checklists selected by the list filters (child, specialist,
+// from, to, q) in the order of GET /api/checklist. For format=csv (default)
+// layout=long (default) writes one row per answer, layout=wide one row per
+// checklist with a column per question. format=xlsx writes an Excel workbook
+// with a sheet per checklist, format=ndjson one JSON object per checklist
+// and line, in the shape of GET /api/checklist/{id}. CSV is written in the
+// encoding (utf-8, utf-8-bom or windows-1251) and with the delimiter (",",
+// ";" or "tab") asked for, so that Excel opens it without an import dialog.
+// profile=<name> writes CSV with the columns, date formats, delimiter and
+// encoding of an export profile, which also sets the layout.
+func exportChecklistsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" && format != "ndjson" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "format must be csv, xlsx or ndjson")
+		return
+	}
+	layout := q.Get("layout")
+	if layout == "" {
+		layout = "long"
+	}
+	if layout != "long" && layout != "wide" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "layout must be long or wide")
+		return
+	}
+	encoding := q.Get("encoding")
+	switch encoding {
+	case "":
+		encoding = encodingUTF8
+	case encodingUTF8, encodingUTF8BOM, encodingCP1251:
+	default:
+		writeError(w, r, http.StatusBadRequest, codeBadRequest,
+			fmt.Sprintf("encoding must be %s, %s or %s", encodingUTF8, encodingUTF8BOM, encodingCP1251))
+		return
+	}
+	var delimiter rune
+	switch q.Get("delimiter") {
+	case "", ",":
+		delimiter = ','
+	case ";":
+		delimiter = ';'
+	case "tab":
+		delimiter = '\t'
+	default:
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, `delimiter must be ",", ";" or "tab"`)
+		return
+	}
+	where, _, args, err := checklistListFilter(orgFrom(r.Context()), q)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), exportTimeout)
+	defer cancel()
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(exportTimeout))
+
+	var profile *ExportProfile
+	if name := q.Get("profile"); name != "" {
+		if format != "csv" {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "export profiles apply to csv exports")
+			return
+		}
+		p, err := loadExportProfile(ctx, name)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "export profile not found")
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load export profile")
+			log.Printf("load export profile %s error: %v", name, err)
+			return
+		}
+		profile, layout = &p, p.Layout
+	}
+
+	// the file is written while the rows are read, which inTx must not do;
+	// the export holds its own read-only transaction instead
+	tx, err := beginTx(ctx, snapshotTx)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to export checklists")
+		log.Printf("checklist export error: %v", err)
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if format == "xlsx" {
+		var n int
+		if err := tx.QueryRowContext(ctx, `SELECT count(*) FROM checklists c`+where, args...).Scan(&n); err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to export checklists")
+			log.Printf("checklist export error: %v", err)
+			return
+		}
+		if n > xlsxMaxSheets {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest,
+				fmt.Sprintf("xlsx export is limited to %d checklists, got %d; narrow the filters", xlsxMaxSheets, n))
+			return
+		}
+	}
+
+	var keys []string
+	if format == "csv" && layout == "wide" && profile == nil {
+		if keys, err = exportAnswerKeys(ctx, tx, where, args); err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to export checklists")
+			log.Printf("checklist export error: %v", err)
+			return
+		}
+	}
+
+	rows, err := queryExportRows(ctx, tx, where, args)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to export checklists")
+		log.Printf("checklist export error: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	switch {
+	case format == "xlsx":
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	case format == "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	case profile != nil:
+		w.Header().Set("Content-Type", csvContentType(profile.Encoding))
+	default:
+		w.Header().Set("Content-Type", csvContentType(encoding))
+	}
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="checklists-%s.%s"`, time.Now().UTC().Format("20060102-150405"), format))
+
+	// headers are already sent past this point; errors truncate the file
+	switch {
+	case format == "xlsx":
+		err = writeXLSX(w, rows)
+	case format == "ndjson":
+		err = writeNDJSON(w, rows)
+	case profile != nil:
+		err = writeProfileCSV(w, rows, *profile)
+	case layout == "wide":
+		err = writeWideCSV(w, rows, keys, delimiter, encoding)
+	default:
+		err = writeLongCSV(w, rows, delimiter, encoding)
+	}
+	if err != nil {
+		log.Printf("checklist export error: %v", err)
+	}
+}
+
+// queryExportRows selects the filtered checklists joined with their answers,
+// one row per answer (or a single row without answers), grouped by checklist.
+// lib/pq reads the result off the connection as the rows are consumed, so
+// exports run in constant memory whatever the size of the dataset.
+func queryExportRows(ctx context.Context, q queryer, where string, args []interface{}) (*sql.Rows, error) {
+	return q.QueryContext(ctx, `
+SELECT c.id, c.child_name, c.date_of_check, c.specialist, c.created_at,
+       c.client_created_at, c.server_received_at, c.updated_at, c.client_uuid, c.child_id, c.specialist_id,
+       a.key_name, a.label, a.value, a.comment
+FROM checklists c
+LEFT JOIN answers a ON a.checklist_id = c.id`+where+`
+ORDER BY c.date_of_check DESC NULLS LAST, c.id DESC, a.id`, args...)
+}
+
+// exportAnswerKeys lists the question keys answered in the filtered
+// checklists, in the order they were first stored.
+func exportAnswerKeys(ctx context.Context, q queryer, where string, args []interface{}) ([]string, error) {
+	rows, err := q.QueryContext(ctx, `
+SELECT a.key_name
+FROM checklists c
+JOIN answers a ON a.checklist_id = c.id`+where+`
+GROUP BY a.key_name
+ORDER BY min(a.id)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// forEachExportChecklist assembles the rows of queryExportRows into
+// checklists and calls fn for each of them in order.
+func forEachExportChecklist(rows *sql.Rows, fn func(ChecklistDetail) error) error {
+	var (
+		cur     ChecklistDetail
+		started bool
+	)
+	for rows.Next() {
+		var (
+			id                         int64
+			child, spc                 sql.NullString
+			date, client, recv, upd    sql.NullTime
+			createdAt                  time.Time
+			clientUUID                 sql.NullString
+			childID, specialistID      sql.NullInt64
+			key, label, value, comment sql.NullString
+		)
+		if err := rows.Scan(&id, &child, &date, &spc, &createdAt, &client, &recv, &upd, &clientUUID, &childID, &specialistID,
+			&key, &label, &value, &comment); err != nil {
+			return err
+		}
+		if !started || id != cur.ID {
+			if started {
+				if err := fn(cur); err != nil {
+					return err
+				}
+			}
+			created := createdAt.UTC().Format(time.RFC3339)
+			cur = ChecklistDetail{ID: id}
+			cur.ChildName, cur.Date, cur.Specialist, cur.CreatedAt = stringPtr(child), datePtr(date), stringPtr(spc), &created
+			cur.ClientCreatedAt, cur.ServerReceivedAt, cur.UpdatedAt = timePtr(client), timePtr(recv), timePtr(upd)
+			cur.ClientUUID = stringPtr(clientUUID)
+			if childID.Valid {
+				cur.ChildID = &childID.Int64
+			}
+			if specialistID.Valid {
+				cur.SpecialistID = &specialistID.Int64
+			}
+			cur.Answers = []Answer{}
+			started = true
+		}
+		if key.Valid {
+			cur.Answers = append(cur.Answers, Answer{Key: key.String, Label: label.String, Value: stringPtr(value), Comment: stringPtr(comment)})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if started {
+		return fn(cur)
+	}
+	return nil
+}
+
+// exportChecklistFields returns the leading export columns of c.
+func exportChecklistFields(c ChecklistDetail) []string {
+	return []string{strconv.FormatInt(c.ID, 10), deref(c.ChildName), deref(c.Date), deref(c.Specialist), deref(c.CreatedAt)}
+}
+
+func writeLongCSV(w io.Writer, rows *sql.Rows, delimiter rune, encoding string) error {
+	cw, flush := newCSVWriter(w, delimiter, encoding)
+	_ = cw.Write(append(append([]string{}, exportColumns...), "key", "label", "value", "comment"))
+	err := forEachExportChecklist(rows, func(c ChecklistDetail) error {
+		head := exportChecklistFields(c)
+		if len(c.Answers) == 0 {
+			return cw.Write(csvSafe(append(head, "", "", "", "")))
+		}
+		for _, a := range c.Answers {
+			rec := append(append([]string{}, head...), a.Key, a.Label, deref(a.Value), deref(a.Comment))
+			if err := cw.Write(csvSafe(rec)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// writeWideCSV writes one row per checklist with the answer value of every
+// key in keys; comments are only part of the long layout.
+func writeWideCSV(w io.Writer, rows *sql.Rows, keys []string, delimiter rune, encoding string) error {
+	cw, flush := newCSVWriter(w, delimiter, encoding)
+	_ = cw.Write(append(append([]string{}, exportColumns...), keys...))
+	err := forEachExportChecklist(rows, func(c ChecklistDetail) error {
+		values := make(map[string]string, len(c.Answers))
+		for _, a := range c.Answers {
+			values[a.Key] = deref(a.Value)
+		}
+		rec := exportChecklistFields(c)
+		for _, k := range keys {
+			rec = append(rec, values[k])
+		}
+		return cw.Write(csvSafe(rec))
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// writeNDJSON writes one checklist per line. Output is flushed every
+// ndjsonFlushEvery checklists so consumers can start processing early.
+func writeNDJSON(w http.ResponseWriter, rows *sql.Rows) error {
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	n := 0
+	return forEachExportChecklist(rows, func(c ChecklistDetail) error {
+		if err := enc.Encode(c); err != nil {
+			return err
+		}
+		if n++; n%ndjsonFlushEvery == 0 {
+			_ = rc.Flush()
+		}
+		return nil
+	})
+}
+
+// csvSafe keeps spreadsheet applications from evaluating free text as a
+// formula by prefixing such cells with an apostrophe.
+func csvSafe(rec []string) []string {
+	for i, v := range rec {
+		if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) && v != "-" {
+			rec[i] = "'" + v
+		}
+	}
+	return rec
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
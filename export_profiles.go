@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/transform"
+)
+
+const (
+	eventExportProfileCreated = "export_profile.created"
+	eventExportProfileUpdated = "export_profile.updated"
+	eventExportProfileDeleted = "export_profile.deleted"
+)
+
+// CSV encodings: UTF-8, UTF-8 with a byte order mark, which Excel needs to
+// detect UTF-8, and Windows-1251.
+const (
+	encodingUTF8    = "utf-8"
+	encodingUTF8BOM = "utf-8-bom"
+	encodingCP1251  = "windows-1251"
+)
+
+// exportSources are the values a profile column may take, by layout. Wide
+// profiles pick answers with "answer.<key>".
+var exportSources = map[string]map[string]bool{
+	"long": {"checklist_id": true, "child_name": true, "child_id": true, "date": true, "specialist": true,
+		"specialist_id": true, "created_at": true, "client_uuid": true, "key": true, "label": true, "value": true, "comment": true},
+	"wide": {"checklist_id": true, "child_name": true, "child_id": true, "date": true, "specialist": true,
+		"specialist_id": true, "created_at": true, "client_uuid": true},
+}
+
+var (
+	exportProfileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	exportDateFormatPattern  = regexp.MustCompile(`^(YYYY|YY|MM|DD|HH|mm|ss|[ .\-/:T])+$`)
+	exportDateFormatLayout   = strings.NewReplacer("YYYY", "2006", "YY", "06", "MM", "01", "DD", "02", "HH", "15", "mm", "04", "ss", "05")
+)
+
+// ExportProfile is a named CSV layout for a recipient of exports: which
+// columns in which order under which headers, how dates are written, the
+// delimiter and the encoding. Profiles belong to an organization.
+type ExportProfile struct {
+	ID             int64          `json:"id"`
+	Name           string         `json:"name"`
+	Layout         string         `json:"layout"` // long (a row per answer) or wide (a row per checklist)
+	Columns        []ExportColumn `json:"columns"`
+	DateFormat     string         `json:"dateFormat"`
+	DateTimeFormat string         `json:"dateTimeFormat"`
+	Delimiter      string         `json:"delimiter"`
+	Encoding       string         `json:"encoding"`
+	CreatedAt      time.Time      `json:"createdAt"`
+	UpdatedAt      time.Time      `json:"updatedAt"`
+}
+
+// ExportColumn is a column of a profile: Source names the value and Header
+// the column title, Source when empty.
+type ExportColumn struct {
+	Source string `json:"source"`
+	Header string `json:"header"`
+}
+
+type exportProfileInput struct {
+	Name           string         `json:"name"`
+	Layout         string         `json:"layout"`
+	Columns        []ExportColumn `json:"columns"`
+	DateFormat     string         `json:"dateFormat"`
+	DateTimeFormat string         `json:"dateTimeFormat"`
+	Delimiter      string         `json:"delimiter"`
+	Encoding       string         `json:"encoding"`
+}
+
+func (in *exportProfileInput) validate() error {
+	if in.Layout == "" {
+		in.Layout = "long"
+	}
+	sources, ok := exportSources[in.Layout]
+	if !ok {
+		return errors.New("layout must be long or wide")
+	}
+	if len(in.Columns) == 0 {
+		return errors.New("columns must be provided")
+	}
+	for i := range in.Columns {
+		c := &in.Columns[i]
+		c.Source = strings.TrimSpace(c.Source)
+		key, isAnswer := strings.CutPrefix(c.Source, "answer.")
+		if !sources[c.Source] && !(in.Layout == "wide" && isAnswer && key != "") {
+			return fmt.Errorf("columns[%d].source %q is not available in the %s layout", i, c.Source, in.Layout)
+		}
+		if c.Header = strings.TrimSpace(c.Header); c.Header == "" {
+			c.Header = c.Source
+		}
+	}
+	if in.DateFormat == "" {
+		in.DateFormat = "YYYY-MM-DD"
+	}
+	if in.DateTimeFormat == "" {
+		in.DateTimeFormat = "YYYY-MM-DDTHH:mm:ss"
+	}
+	if !exportDateFormatPattern.MatchString(in.DateFormat) || !exportDateFormatPattern.MatchString(in.DateTimeFormat) {
+		return errors.New("dateFormat and dateTimeFormat may consist of YYYY, YY, MM, DD, HH, mm, ss and the separators . - / : T and space")
+	}
+	switch in.Delimiter {
+	case "":
+		in.Delimiter = ","
+	case ",", ";", "\t":
+	default:
+		return errors.New(`delimiter must be ",", ";" or "\t"`)
+	}
+	switch in.Encoding {
+	case "":
+		in.Encoding = encodingUTF8
+	case encodingUTF8, encodingUTF8BOM, encodingCP1251:
+	default:
+		return fmt.Errorf("encoding must be %s, %s or %s", encodingUTF8, encodingUTF8BOM, encodingCP1251)
+	}
+	return nil
+}
+
+const exportProfileColumns = `id, name, layout, columns, date_format, datetime_format, delimiter, encoding, created_at, updated_at`
+
+// exportProfilesHandler handles GET (list) and POST (create) on
+// /api/admin/export-profiles.
+func exportProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listExportProfiles(w, r)
+	case http.MethodPost:
+		saveExportProfile(w, r, "")
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// exportProfileHandler handles PUT and DELETE on
+// /api/admin/export-profiles/{name}.
+func exportProfileHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	switch r.Method {
+	case http.MethodPut:
+		saveExportProfile(w, r, name)
+	case http.MethodDelete:
+		deleteExportProfile(w, r, name)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+func listExportProfiles(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `SELECT `+exportProfileColumns+` FROM export_profiles WHERE org_id = $1 ORDER BY name`, orgFrom(ctx))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list export profiles")
+		log.Printf("list export profiles error: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	items := []ExportProfile{}
+	for rows.Next() {
+		p, err := scanExportProfile(rows)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list export profiles")
+			log.Printf("scan export profile error: %v", err)
+			return
+		}
+		items = append(items, p)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list export profiles")
+		log.Printf("list export profiles error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+}
+
+// saveExportProfile creates a profile (name == "", named in the body) or
+// replaces profile name.
+func saveExportProfile(w http.ResponseWriter, r *http.Request, name string) {
+	var in exportProfileInput
+	warnings, err := decodeJSON(r.Body, &in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	create := name == ""
+	if create {
+		name = strings.TrimSpace(in.Name)
+	}
+	if !exportProfileNamePattern.MatchString(name) {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "name must consist of lowercase letters, digits, - and _")
+		return
+	}
+	if err := in.validate(); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	columns, err := json.Marshal(in.Columns)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to encode columns")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var p ExportProfile
+	status, event := http.StatusCreated, eventExportProfileCreated
+	if !create {
+		status, event = http.StatusOK, eventExportProfileUpdated
+	}
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		var err error
+		if create {
+			p, err = scanExportProfile(tx.QueryRowContext(ctx, `
+INSERT INTO export_profiles (org_id, name, layout, columns, date_format, datetime_format, delimiter, encoding)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (org_id, name) DO NOTHING RETURNING `+exportProfileColumns,
+				orgFrom(ctx), name, in.Layout, string(columns), in.DateFormat, in.DateTimeFormat, in.Delimiter, in.Encoding))
+			if errors.Is(err, sql.ErrNoRows) {
+				return newStatusError(http.StatusConflict, codeConflict, "export profile already exists")
+			}
+		} else {
+			p, err = scanExportProfile(tx.QueryRowContext(ctx, `
+UPDATE export_profiles SET layout = $3, columns = $4, date_format = $5, datetime_format = $6, delimiter = $7,
+       encoding = $8, updated_at = now()
+WHERE org_id = $1 AND name = $2 RETURNING `+exportProfileColumns,
+				orgFrom(ctx), name, in.Layout, string(columns), in.DateFormat, in.DateTimeFormat, in.Delimiter, in.Encoding))
+			if errors.Is(err, sql.ErrNoRows) {
+				return newStatusError(http.StatusNotFound, codeNotFound, "export profile not found")
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("save export profile %s: %w", name, err)
+		}
+		return appendEvent(ctx, tx, event, p.ID, map[string]interface{}{"id": p.ID, "name": p.Name})
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to save export profile")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"profile": p, "warnings": nonNilWarnings(warnings)})
+}
+
+func deleteExportProfile(w http.ResponseWriter, r *http.Request, name string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	err := inTx(ctx, nil, func(tx *sql.Tx) error {
+		var id int64
+		err := tx.QueryRowContext(ctx, `DELETE FROM export_profiles WHERE org_id = $1 AND name = $2 RETURNING id`,
+			orgFrom(ctx), name).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newStatusError(http.StatusNotFound, codeNotFound, "export profile not found")
+		}
+		if err != nil {
+			return fmt.Errorf("delete export profile %s: %w", name, err)
+		}
+		return appendEvent(ctx, tx, eventExportProfileDeleted, id, map[string]interface{}{"id": id, "name": name})
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to delete export profile")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadExportProfile returns profile name of the caller's organization.
+func loadExportProfile(ctx context.Context, name string) (ExportProfile, error) {
+	return scanExportProfile(db.QueryRowContext(ctx,
+		`SELECT `+exportProfileColumns+` FROM export_profiles WHERE org_id = $1 AND name = $2`, orgFrom(ctx), name))
+}
+
+func scanExportProfile(row rowScanner) (ExportProfile, error) {
+	var (
+		p       ExportProfile
+		columns []byte
+	)
+	err := row.Scan(&p.ID, &p.Name, &p.Layout, &columns, &p.DateFormat, &p.DateTimeFormat, &p.Delimiter, &p.Encoding,
+		&p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal(columns, &p.Columns)
+	return p, err
+}
+
+// newCSVWriter returns a CSV writer with delimiter writing to w in charset,
+// and writes the byte order mark of utf-8-bom. Characters that Windows-1251
+// lacks are replaced with its substitute character. The returned flush must
+// be called at the end: it flushes the CSV writer and the encoder.
+func newCSVWriter(w io.Writer, delimiter rune, charset string) (*csv.Writer, func() error) {
+	var enc io.WriteCloser
+	switch charset {
+	case encodingUTF8BOM:
+		_, _ = io.WriteString(w, "\ufeff")
+	case encodingCP1251:
+		enc = transform.NewWriter(w, encoding.ReplaceUnsupported(charmap.Windows1251.NewEncoder()))
+		w = enc
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = delimiter
+	return cw, func() error {
+		cw.Flush()
+		if err := cw.Error(); err != nil || enc == nil {
+			return err
+		}
+		return enc.Close()
+	}
+}
+
+// csvContentType is the Content-Type of a CSV file in charset.
+func csvContentType(charset string) string {
+	if charset == encodingCP1251 {
+		return "text/csv; charset=windows-1251"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// writeProfileCSV writes the checklists of rows in the layout of profile p.
+func writeProfileCSV(w io.Writer, rows *sql.Rows, p ExportProfile) error {
+	cw, flush := newCSVWriter(w, rune(p.Delimiter[0]), p.Encoding)
+	dateLayout := exportDateFormatLayout.Replace(p.DateFormat)
+	dateTimeLayout := exportDateFormatLayout.Replace(p.DateTimeFormat)
+
+	header := make([]string, len(p.Columns))
+	for i, c := range p.Columns {
+		header[i] = c.Header
+	}
+	_ = cw.Write(header)
+
+	record := func(c ChecklistDetail, a *Answer, values map[string]string) []string {
+		rec := make([]string, len(p.Columns))
+		for i, col := range p.Columns {
+			switch col.Source {
+			case "checklist_id":
+				rec[i] = strconv.FormatInt(c.ID, 10)
+			case "child_name":
+				rec[i] = deref(c.ChildName)
+			case "child_id":
+				rec[i] = formatInt64Ptr(c.ChildID)
+			case "date":
+				rec[i] = reformatTime(deref(c.Date), "2006-01-02", dateLayout)
+			case "specialist":
+				rec[i] = deref(c.Specialist)
+			case "specialist_id":
+				rec[i] = formatInt64Ptr(c.SpecialistID)
+			case "created_at":
+				rec[i] = reformatTime(deref(c.CreatedAt), time.RFC3339, dateTimeLayout)
+			case "client_uuid":
+				rec[i] = deref(c.ClientUUID)
+			case "key":
+				if a != nil {
+					rec[i] = a.Key
+				}
+			case "label":
+				if a != nil {
+					rec[i] = a.Label
+				}
+			case "value":
+				if a != nil {
+					rec[i] = deref(a.Value)
+				}
+			case "comment":
+				if a != nil {
+					rec[i] = deref(a.Comment)
+				}
+			default:
+				rec[i] = values[strings.TrimPrefix(col.Source, "answer.")]
+			}
+		}
+		return csvSafe(rec)
+	}
+
+	err := forEachExportChecklist(rows, func(c ChecklistDetail) error {
+		if p.Layout == "wide" {
+			values := make(map[string]string, len(c.Answers))
+			for _, a := range c.Answers {
+				values[a.Key] = deref(a.Value)
+			}
+			return cw.Write(record(c, nil, values))
+		}
+		if len(c.Answers) == 0 {
+			return cw.Write(record(c, nil, nil))
+		}
+		for i := range c.Answers {
+			if err := cw.Write(record(c, &c.Answers[i], nil)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// reformatTime rewrites v from layout from to layout to, or returns it
+// unchanged when it does not parse.
+func reformatTime(v, from, to string) string {
+	t, err := time.Parse(from, v)
+	if err != nil {
+		return v
+	}
+	return t.Format(to)
+}
+
+func formatInt64Ptr(n *int64) string {
+	if n == nil {
+		return ""
+	}
+	return strconv.FormatInt(*n, 10)
+}
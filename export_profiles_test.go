@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportProfileInputValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      exportProfileInput
+		wantErr string
+	}{
+		{name: "defaults", in: exportProfileInput{Columns: []ExportColumn{{Source: "checklist_id"}}}},
+		{name: "wide answer column", in: exportProfileInput{Layout: "wide", Columns: []ExportColumn{{Source: "answer.speech"}}}},
+		{name: "formats", in: exportProfileInput{Columns: []ExportColumn{{Source: "date"}}, DateFormat: "DD.MM.YYYY",
+			DateTimeFormat: "DD.MM.YY HH:mm", Delimiter: ";", Encoding: encodingCP1251}},
+		{name: "unknown layout", in: exportProfileInput{Layout: "tall", Columns: []ExportColumn{{Source: "date"}}}, wantErr: "layout"},
+		{name: "no columns", in: exportProfileInput{}, wantErr: "columns must be provided"},
+		{name: "unknown source", in: exportProfileInput{Columns: []ExportColumn{{Source: "birth_date"}}}, wantErr: `"birth_date"`},
+		{name: "answer column in long layout", in: exportProfileInput{Columns: []ExportColumn{{Source: "answer.speech"}}}, wantErr: "long layout"},
+		{name: "answer column without key", in: exportProfileInput{Layout: "wide", Columns: []ExportColumn{{Source: "answer."}}}, wantErr: "wide layout"},
+		{name: "key column in wide layout", in: exportProfileInput{Layout: "wide", Columns: []ExportColumn{{Source: "key"}}}, wantErr: "wide layout"},
+		{name: "bad date format", in: exportProfileInput{Columns: []ExportColumn{{Source: "date"}}, DateFormat: "%Y-%m-%d"}, wantErr: "dateFormat"},
+		{name: "bad delimiter", in: exportProfileInput{Columns: []ExportColumn{{Source: "date"}}, Delimiter: "|"}, wantErr: "delimiter"},
+		{name: "bad encoding", in: exportProfileInput{Columns: []ExportColumn{{Source: "date"}}, Encoding: "latin1"}, wantErr: "encoding"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.in.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExportProfileInputDefaults(t *testing.T) {
+	in := exportProfileInput{Columns: []ExportColumn{{Source: " child_name ", Header: " "}}}
+	if err := in.validate(); err != nil {
+		t.Fatal(err)
+	}
+	want := exportProfileInput{
+		Layout:         "long",
+		Columns:        []ExportColumn{{Source: "child_name", Header: "child_name"}},
+		DateFormat:     "YYYY-MM-DD",
+		DateTimeFormat: "YYYY-MM-DDTHH:mm:ss",
+		Delimiter:      ",",
+		Encoding:       encodingUTF8,
+	}
+	if !reflect.DeepEqual(in, want) {
+		t.Errorf("validated input = %+v, want %+v", in, want)
+	}
+}
+
+func TestReformatTime(t *testing.T) {
+	tests := []struct {
+		v, from, to, want string
+	}{
+		{"2024-03-05", "2006-01-02", exportDateFormatLayout.Replace("DD.MM.YYYY"), "05.03.2024"},
+		{"2024-03-05T14:07:09Z", "2006-01-02T15:04:05Z07:00", exportDateFormatLayout.Replace("DD/MM/YY HH:mm"), "05/03/24 14:07"},
+		{"", "2006-01-02", "02.01.2006", ""},
+		{"not a date", "2006-01-02", "02.01.2006", "not a date"},
+	}
+	for _, tt := range tests {
+		if got := reformatTime(tt.v, tt.from, tt.to); got != tt.want {
+			t.Errorf("reformatTime(%q, %q, %q) = %q, want %q", tt.v, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
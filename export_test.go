@@ -0,0 +1,22 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCSVSafe(t *testing.T) {
+	tests := []struct {
+		in, want []string
+	}{
+		{[]string{"", "-", "Иванов", "1+1"}, []string{"", "-", "Иванов", "1+1"}},
+		{[]string{"=SUM(A1:A2)", "+7 900", "-1", "@cmd"}, []string{"'=SUM(A1:A2)", "'+7 900", "'-1", "'@cmd"}},
+		{[]string{"\tx", "\rx", "'quoted"}, []string{"'\tx", "'\rx", "'quoted"}},
+	}
+	for _, tt := range tests {
+		in := append([]string(nil), tt.in...)
+		if got := csvSafe(in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("csvSafe(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// redacted replaces personal data in recorded fixtures.
+const redacted = "REDACTED"
+
+// sensitiveFields are JSON object keys whose string values are redacted.
+var sensitiveFields = map[string]bool{
+	"childName":    true,
+	"specialist":   true,
+	"comment":      true,
+	"name":         true,
+	"birthDate":    true,
+	"externalId":   true,
+	"login":        true,
+	"email":        true,
+	"password":     true,
+	"accessToken":  true,
+	"refreshToken": true,
+}
+
+// sensitiveParams are query parameters whose values are redacted. Incoming
+// requests are sanitized the same way on replay so they still match.
+var sensitiveParams = map[string]bool{
+	"child":      true,
+	"childName":  true,
+	"specialist": true,
+	"q":          true,
+}
+
+// httpFixture is one recorded request/response pair, stored as a JSON file.
+type httpFixture struct {
+	Method      string      `json:"method"`
+	URI         string      `json:"uri"`
+	RequestBody string      `json:"requestBody,omitempty"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        string      `json:"body"`
+}
+
+// recordingWriter captures the status and body passed to the client.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	rw.body.Write(p)
+	return rw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// recordMiddleware writes every /api request and its response to dir as a
+// sanitized fixture file, numbered in arrival order.
+func recordMiddleware(dir string, next http.Handler) http.Handler {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Fatalf("failed to create fixture dir: %v", err)
+	}
+	// continue numbering after fixtures from a previous recording session
+	existing, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	var seq atomic.Int64
+	seq.Store(int64(len(existing)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reqBody, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "failed to read body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(reqBody))
+
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		header := rw.Header().Clone()
+		header.Del("Set-Cookie")
+		header.Del("Content-Length")
+		f := httpFixture{
+			Method:      r.Method,
+			URI:         sanitizeURI(r.URL),
+			RequestBody: sanitizeBody(reqBody),
+			Status:      rw.status,
+			Header:      header,
+			Body:        sanitizeBody(rw.body.Bytes()),
+		}
+		name := filepath.Join(dir, fmt.Sprintf("%06d.json", seq.Add(1)))
+		if err := writeFixture(name, f); err != nil {
+			log.Printf("write fixture %s error: %v", name, err)
+		}
+	})
+}
+
+func writeFixture(name string, f httpFixture) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0o644)
+}
+
+// replayHandler serves recorded fixtures. Requests are matched by method and
+// sanitized URI; repeated requests get the recorded responses in order and
+// the last one is repeated once they run out.
+type replayHandler struct {
+	mu       sync.Mutex
+	fixtures map[string][]httpFixture
+	next     map[string]int
+	total    int
+}
+
+func newReplayHandler(dir string) (*replayHandler, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	h := &replayHandler{fixtures: make(map[string][]httpFixture), next: make(map[string]int)}
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var f httpFixture
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		key := f.Method + " " + f.URI
+		h.fixtures[key] = append(h.fixtures[key], f)
+		h.total++
+	}
+	return h, nil
+}
+
+func (h *replayHandler) len() int {
+	return h.total
+}
+
+func (h *replayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + sanitizeURI(r.URL)
+
+	h.mu.Lock()
+	fs := h.fixtures[key]
+	i := h.next[key]
+	if i < len(fs)-1 {
+		h.next[key]++
+	}
+	h.mu.Unlock()
+
+	if len(fs) == 0 {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "no recorded response for "+key)
+		return
+	}
+
+	f := fs[i]
+	for k, vs := range f.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(f.Status)
+	_, _ = io.WriteString(w, f.Body)
+}
+
+// sanitizeURI returns the request URI with sensitive query values redacted.
+func sanitizeURI(u *url.URL) string {
+	q := u.Query()
+	if len(q) == 0 {
+		return u.Path
+	}
+	for k, vs := range q {
+		if sensitiveParams[k] {
+			for i := range vs {
+				vs[i] = redacted
+			}
+		}
+	}
+	return u.Path + "?" + q.Encode()
+}
+
+// sanitizeBody redacts sensitive fields of a JSON or NDJSON body. Other
+// bodies, such as CSV imports and exports, cannot be sanitized field by
+// field and are replaced as a whole.
+func sanitizeBody(body []byte) string {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ""
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var values []string
+	for {
+		var v interface{}
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return redacted
+		}
+		data, err := json.Marshal(redactJSON(v))
+		if err != nil {
+			return redacted
+		}
+		values = append(values, string(data))
+	}
+	return strings.Join(values, "\n")
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if _, ok := val.(string); ok && sensitiveFields[k] {
+				t[k] = redacted
+				continue
+			}
+			t[k] = redactJSON(val)
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = redactJSON(t[i])
+		}
+	}
+	return v
+}
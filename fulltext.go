@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// searchConfig is the Postgres text search configuration of the checklist
+// search vector.
+const searchConfig = "russian"
+
+// fullTextResultLimit caps GET /api/checklist/fulltext results.
+const fullTextResultLimit = 100
+
+// checklistSearchText is the searchable text of a checklist aliased as c:
+// the child's name and the labels, values and comments of its answers.
+const checklistSearchText = `concat_ws(' ', c.child_name,
+  (SELECT string_agg(concat_ws(' ', a.label, a.value, a.comment), ' ' ORDER BY a.id) FROM answers a WHERE a.checklist_id = c.id))`
+
+// checklistSearchVector computes checklists.search_vector for c. The child's
+// name ranks above answers, answers above comments.
+const checklistSearchVector = `setweight(to_tsvector('` + searchConfig + `', COALESCE(c.child_name, '')), 'A') ||
+  setweight(to_tsvector('` + searchConfig + `', COALESCE((SELECT string_agg(concat_ws(' ', a.label, a.value), ' ') FROM answers a WHERE a.checklist_id = c.id), '')), 'B') ||
+  setweight(to_tsvector('` + searchConfig + `', COALESCE((SELECT string_agg(a.comment, ' ') FROM answers a WHERE a.checklist_id = c.id), '')), 'C')`
+
+// searchQuery turns the user's search string, in web search syntax, into a
+// tsquery; it is used as fmt format with the parameter number.
+const searchQuery = `websearch_to_tsquery('` + searchConfig + `', $%d)`
+
+// FullTextHit is a checklist found by full-text search.
+type FullTextHit struct {
+	ChecklistSummary
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"`
+}
+
+// refreshSearchVectors recomputes the search vector of the given checklists.
+// Every change of a checklist's name or answers must call it in the same
+// transaction.
+func refreshSearchVectors(ctx context.Context, tx *sql.Tx, ids ...int64) error {
+	_, err := tx.ExecContext(ctx,
+		`UPDATE checklists c SET search_vector = `+checklistSearchVector+` WHERE c.id = ANY($1)`, pq.Array(ids))
+	return err
+}
+
+// fullTextSearchHandler handles GET /api/checklist/fulltext?q=...&limit=N:
+// checklists matching q, best match first, each with a snippet of the matched
+// text. Matched words are wrapped in ** in the snippet.
+func fullTextSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	text := strings.TrimSpace(q.Get("q"))
+	if text == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "q must be provided")
+		return
+	}
+	limit := defaultPageLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > fullTextResultLimit {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "limit must be between 1 and 100")
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var items []FullTextHit
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `
+WITH q AS (SELECT `+fmt.Sprintf(searchQuery, 1)+` AS query)
+SELECT `+checklistSummaryColumns+`, ts_rank(c.search_vector, q.query) AS rank,
+  ts_headline('`+searchConfig+`', `+checklistSearchText+`, q.query,
+              'StartSel=**, StopSel=**, MaxFragments=3, FragmentDelimiter=" … "')
+FROM checklists c, q
+WHERE c.org_id = $3 AND c.archived_at IS NULL AND c.search_vector @@ q.query
+ORDER BY rank DESC, c.id DESC
+LIMIT $2`, text, limit, orgFrom(ctx))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		items = []FullTextHit{}
+		for rows.Next() {
+			var (
+				h                  FullTextHit
+				childID, spcID     sql.NullInt64
+				child, spc         sql.NullString
+				date, client, recv sql.NullTime
+			)
+			if err := rows.Scan(&h.ID, &childID, &child, &date, &spcID, &spc, &client, &recv, &h.AnswerCount, &h.Rank, &h.Snippet); err != nil {
+				return err
+			}
+			h.ChildName, h.Date, h.Specialist = stringPtr(child), datePtr(date), stringPtr(spc)
+			h.ClientCreatedAt, h.ServerReceivedAt = timePtr(client), timePtr(recv)
+			if childID.Valid {
+				h.ChildID = &childID.Int64
+			}
+			if spcID.Valid {
+				h.SpecialistID = &spcID.Int64
+			}
+			items = append(items, h)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to search checklists")
+		log.Printf("full-text search error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"q": text, "items": items}
+	_ = json.NewEncoder(w).Encode(resp)
+}
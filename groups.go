@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InterventionGroup is a named snapshot of the children matched by a search.
+type InterventionGroup struct {
+	ID        int64             `json:"id"`
+	Name      string            `json:"name"`
+	Criteria  []answerPredicate `json:"criteria"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Members   []GroupMember     `json:"members,omitempty"`
+	Size      int               `json:"size"`
+}
+
+// GroupMember is a child in a group together with the checklist that matched.
+// Children of the registry are identified by ChildID, the others by name.
+type GroupMember struct {
+	ChildID     *int64 `json:"childId"`
+	ChildName   string `json:"childName"`
+	ChecklistID int64  `json:"checklistId"`
+}
+
+type groupInput struct {
+	Name     string            `json:"name"`
+	Criteria []answerPredicate `json:"criteria"`
+}
+
+// groupsHandler handles GET (list) and POST (save search result) on /api/groups
+func groupsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listGroups(w, r)
+	case http.MethodPost:
+		createGroup(w, r)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+func createGroup(w http.ResponseWriter, r *http.Request) {
+	var in groupInput
+	warnings, err := decodeJSON(r.Body, &in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "name must be provided")
+		return
+	}
+	if err := validateAnswerPredicates(in.Criteria); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	members, err := matchGroupMembers(ctx, in.Criteria)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to search checklists")
+		log.Printf("group search error: %v", err)
+		return
+	}
+	criteria, err := json.Marshal(in.Criteria)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to encode criteria")
+		return
+	}
+
+	g := InterventionGroup{Name: in.Name, Criteria: in.Criteria, Members: members, Size: len(members)}
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx,
+			`INSERT INTO intervention_groups (name, criteria, org_id) VALUES ($1, $2, $3) RETURNING id, created_at`,
+			g.Name, string(criteria), orgFrom(ctx)).Scan(&g.ID, &g.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("insert group: %w", err)
+		}
+
+		stmt, err := tx.PrepareContext(ctx, `INSERT INTO intervention_group_members (group_id, child_id, child_name, checklist_id) VALUES ($1,$2,$3,$4)`)
+		if err != nil {
+			return fmt.Errorf("prepare member insert: %w", err)
+		}
+		defer stmt.Close()
+
+		for _, m := range members {
+			if _, err := stmt.ExecContext(ctx, g.ID, m.ChildID, m.ChildName, m.ChecklistID); err != nil {
+				return fmt.Errorf("insert group member %v: %w", m, err)
+			}
+		}
+		return appendEvent(ctx, tx, eventGroupCreated, g.ID, map[string]interface{}{"id": g.ID, "name": g.Name})
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to insert group")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	resp := struct {
+		InterventionGroup
+		Warnings []string `json:"warnings"`
+	}{g, nonNilWarnings(warnings)}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func listGroups(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var items []InterventionGroup
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `
+SELECT g.id, g.name, g.criteria, g.created_at,
+       (SELECT count(*) FROM intervention_group_members m WHERE m.group_id = g.id)
+FROM intervention_groups g WHERE g.org_id = $1 ORDER BY g.created_at DESC, g.id DESC`, orgFrom(ctx))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		items = []InterventionGroup{}
+		for rows.Next() {
+			g, err := scanGroup(rows)
+			if err != nil {
+				return err
+			}
+			items = append(items, g)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list groups")
+		log.Printf("list groups error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+}
+
+// groupHandler handles GET /api/groups/{id} (saved snapshot) and DELETE.
+func groupHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid group id")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		g, err := loadGroup(ctx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "group not found")
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load group")
+			log.Printf("load group %d error: %v", id, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(g)
+	case http.MethodDelete:
+		deleteGroup(ctx, w, r, id)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+func deleteGroup(ctx context.Context, w http.ResponseWriter, r *http.Request, id int64) {
+	err := inTx(ctx, nil, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `DELETE FROM intervention_groups WHERE id = $1 AND org_id = $2`, id, orgFrom(ctx))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return newStatusError(http.StatusNotFound, codeNotFound, "group not found")
+		}
+		return appendEvent(ctx, tx, eventGroupDeleted, id, map[string]interface{}{"id": id})
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to delete group")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// groupRerunHandler handles GET /api/groups/{id}/rerun: it evaluates the saved
+// criteria against current data and reports who entered and left the group.
+// The saved snapshot itself is not modified.
+func groupRerunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid group id")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	g, err := loadGroup(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "group not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load group")
+		log.Printf("load group %d error: %v", id, err)
+		return
+	}
+
+	current, err := matchGroupMembers(ctx, g.Criteria)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to search checklists")
+		log.Printf("group rerun search error: %v", err)
+		return
+	}
+
+	// Members saved without a child id (unlinked children, and snapshots taken
+	// before members had one) are matched by name.
+	savedIDs, savedNames := make(map[int64]bool), make(map[string]bool)
+	for _, m := range g.Members {
+		if m.ChildID != nil {
+			savedIDs[*m.ChildID] = true
+		} else {
+			savedNames[memberName(m)] = true
+		}
+	}
+	entered, left := []GroupMember{}, []GroupMember{}
+	for _, m := range current {
+		switch {
+		case m.ChildID != nil && savedIDs[*m.ChildID]:
+			delete(savedIDs, *m.ChildID)
+		case savedNames[memberName(m)]:
+			delete(savedNames, memberName(m))
+		default:
+			entered = append(entered, m)
+		}
+	}
+	for _, m := range g.Members {
+		if (m.ChildID != nil && savedIDs[*m.ChildID]) || (m.ChildID == nil && savedNames[memberName(m)]) {
+			left = append(left, m)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{
+		"group":   g,
+		"current": current,
+		"entered": entered,
+		"left":    left,
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// matchGroupMembers runs the search over all children, without the cap of
+// GET /api/checklist/search, with the latest matching checklist of each.
+func matchGroupMembers(ctx context.Context, preds []answerPredicate) ([]GroupMember, error) {
+	var items []ChildMatch
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		var err error
+		items, err = findChildrenByAnswers(ctx, tx, preds, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	members := make([]GroupMember, 0, len(items))
+	for _, it := range items {
+		m := GroupMember{ChildID: it.ChildID, ChecklistID: it.Checklist.ID}
+		if it.ChildName != nil {
+			m.ChildName = *it.ChildName
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+// memberName is the name by which a member without a child id is matched.
+func memberName(m GroupMember) string {
+	return strings.ToLower(strings.TrimSpace(m.ChildName))
+}
+
+func loadGroup(ctx context.Context, id int64) (InterventionGroup, error) {
+	var g InterventionGroup
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		var err error
+		g, err = loadGroupTx(ctx, tx, id)
+		return err
+	})
+	return g, err
+}
+
+func loadGroupTx(ctx context.Context, tx *sql.Tx, id int64) (InterventionGroup, error) {
+	g, err := scanGroup(tx.QueryRowContext(ctx, `
+SELECT g.id, g.name, g.criteria, g.created_at,
+       (SELECT count(*) FROM intervention_group_members m WHERE m.group_id = g.id)
+FROM intervention_groups g WHERE g.id = $1 AND g.org_id = $2`, id, orgFrom(ctx)))
+	if err != nil {
+		return g, err
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT child_id, child_name, COALESCE(checklist_id, 0) FROM intervention_group_members WHERE group_id = $1 ORDER BY child_name, child_id`, id)
+	if err != nil {
+		return g, err
+	}
+	defer rows.Close()
+
+	g.Members = []GroupMember{}
+	for rows.Next() {
+		var (
+			m       GroupMember
+			childID sql.NullInt64
+		)
+		if err := rows.Scan(&childID, &m.ChildName, &m.ChecklistID); err != nil {
+			return g, err
+		}
+		if childID.Valid {
+			m.ChildID = &childID.Int64
+		}
+		g.Members = append(g.Members, m)
+	}
+	return g, rows.Err()
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanGroup(row rowScanner) (InterventionGroup, error) {
+	var (
+		g        InterventionGroup
+		criteria []byte
+	)
+	if err := row.Scan(&g.ID, &g.Name, &criteria, &g.CreatedAt, &g.Size); err != nil {
+		return g, err
+	}
+	if err := json.Unmarshal(criteria, &g.Criteria); err != nil {
+		return g, fmt.Errorf("decode criteria: %w", err)
+	}
+	return g, nil
+}
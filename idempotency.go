@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// idempotencyKeyTTL is how long a response is kept for replay; clients
+	// retry within minutes, but a tablet may stay offline for a day.
+	idempotencyKeyTTL = 24 * time.Hour
+
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotentResponse is a stored response to a request with an
+// Idempotency-Key.
+type idempotentResponse struct {
+	status int
+	body   []byte
+}
+
+// errIdempotencyKeyReused is returned when a key comes back with a
+// different request body.
+var errIdempotencyKeyReused = errors.New("Idempotency-Key was already used with a different request")
+
+// idempotencyKey returns the Idempotency-Key header of r, "" when there is
+// none.
+func idempotencyKey(r *http.Request) (string, error) {
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if len(key) > maxIdempotencyKeyLength {
+		return "", fmt.Errorf("Idempotency-Key must be at most %d characters long", maxIdempotencyKeyLength)
+	}
+	for _, c := range key {
+		if c < 0x20 || c > 0x7e {
+			return "", errors.New("Idempotency-Key must consist of printable ASCII characters")
+		}
+	}
+	return key, nil
+}
+
+func hashRequestBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// claimIdempotencyKey reserves key for the request in tx, or returns the
+// response stored for it. Keys belong to the account and organization of
+// the caller. A concurrent request with the same key waits on the row until
+// tx ends and then replays its response.
+func claimIdempotencyKey(ctx context.Context, tx *sql.Tx, key, requestHash string) (*idempotentResponse, error) {
+	org, account := orgFrom(ctx), int64(0)
+	if c := authFrom(ctx); c != nil {
+		account = c.SpecialistID()
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM idempotency_keys WHERE org_id = $1 AND account = $2 AND key = $3 AND created_at < now() - make_interval(secs => $4)`,
+		org, account, key, idempotencyKeyTTL.Seconds()); err != nil {
+		return nil, fmt.Errorf("expire idempotency key: %w", err)
+	}
+	res, err := tx.ExecContext(ctx, `
+INSERT INTO idempotency_keys (org_id, account, key, request_hash) VALUES ($1, $2, $3, $4)
+ON CONFLICT (org_id, account, key) DO NOTHING`, org, account, key, requestHash)
+	if err != nil {
+		return nil, fmt.Errorf("claim idempotency key: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil, nil
+	}
+
+	var (
+		hash   string
+		stored idempotentResponse
+	)
+	err = tx.QueryRowContext(ctx,
+		`SELECT request_hash, status, response FROM idempotency_keys WHERE org_id = $1 AND account = $2 AND key = $3`,
+		org, account, key).Scan(&hash, &stored.status, &stored.body)
+	if err != nil {
+		return nil, fmt.Errorf("load idempotency key: %w", err)
+	}
+	if hash != requestHash {
+		return nil, errIdempotencyKeyReused
+	}
+	return &stored, nil
+}
+
+// storeIdempotentResponse records the response to the request that claimed
+// key, in the transaction that produced it.
+func storeIdempotentResponse(ctx context.Context, tx *sql.Tx, key string, checklistID int64, status int, resp interface{}) error {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	org, account := orgFrom(ctx), int64(0)
+	if c := authFrom(ctx); c != nil {
+		account = c.SpecialistID()
+	}
+	_, err = tx.ExecContext(ctx,
+		`UPDATE idempotency_keys SET checklist_id = $4, status = $5, response = $6 WHERE org_id = $1 AND account = $2 AND key = $3`,
+		org, account, key, checklistID, status, string(body))
+	return err
+}
+
+// writeIdempotentReplay writes a stored response again.
+func writeIdempotentReplay(w http.ResponseWriter, resp *idempotentResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(resp.status)
+	_, _ = w.Write(resp.body)
+	_, _ = w.Write([]byte("\n"))
+}
+
+// startIdempotencyKeyPurge deletes expired idempotency keys once an hour.
+func startIdempotencyKeyPurge() {
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			_, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at < now() - make_interval(secs => $1)`,
+				idempotencyKeyTTL.Seconds())
+			cancel()
+			if err != nil {
+				log.Printf("idempotency key purge error: %v", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
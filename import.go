@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bulk import limits.
+const (
+	maxImportBytes      = 32 << 20
+	maxImportChecklists = 10000
+)
+
+// importItem is one checklist of an import file. Ref and Line identify it in
+// a CSV file, Index is its position in the file.
+type importItem struct {
+	Index     int       `json:"index"`
+	Ref       string    `json:"ref,omitempty"`
+	Line      int       `json:"line,omitempty"`
+	Checklist Checklist `json:"checklist"`
+}
+
+// ImportResult reports the outcome of one imported checklist.
+type ImportResult struct {
+	Index    int      `json:"index"`
+	Ref      string   `json:"ref,omitempty"`
+	Line     int      `json:"line,omitempty"`
+	ID       int64    `json:"id,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// importChecklistsHandler handles POST /api/checklist/import. The body is a
+// JSON array of checklists in the POST /api/checklist format or, with
+// Content-Type text/csv, a file in the long layout of the CSV export. Valid
+// checklists are inserted in transactions of importBatchSize; the response
+// reports the created id or the error of every checklist. With ?async=true
+// the checklists are validated and stored as an import job instead, see
+// runImportJob, and the response is 202 with the job id.
+func importChecklistsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+	var (
+		items    []importItem
+		warnings []string
+		err      error
+	)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/csv" {
+		items, err = parseImportCSV(body)
+		if tooLarge(err) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, codeBadRequest, "import file is too large")
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("invalid csv: %v", err))
+			return
+		}
+	} else {
+		var list []Checklist
+		warnings, err = decodeJSON(body, &list)
+		if tooLarge(err) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, codeBadRequest, "import file is too large")
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+			return
+		}
+		for i, c := range list {
+			items = append(items, importItem{Index: i, Checklist: c})
+		}
+	}
+	if len(items) == 0 {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "no checklists to import")
+		return
+	}
+	if len(items) > maxImportChecklists {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest,
+			fmt.Sprintf("at most %d checklists can be imported at once", maxImportChecklists))
+		return
+	}
+
+	async, _ := strconv.ParseBool(r.URL.Query().Get("async"))
+
+	results := make([]ImportResult, len(items))
+	var valid []int
+	receivedAt := time.Now().UTC()
+	prepared := make([]newChecklist, len(items))
+	for i, it := range items {
+		results[i] = ImportResult{Index: it.Index, Ref: it.Ref, Line: it.Line}
+		nc, ws, err := prepareNewChecklist(it.Checklist, receivedAt, true)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		prepared[i], results[i].Warnings = nc, ws
+		valid = append(valid, i)
+	}
+
+	if async {
+		ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+		defer cancel()
+		jobID, err := createImportJob(ctx, items, results, valid)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to create import job")
+			log.Printf("create import job error: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", fmt.Sprintf("/api/checklist/import/%d", jobID))
+		w.WriteHeader(http.StatusAccepted)
+		resp := map[string]interface{}{
+			"jobId":    jobID,
+			"total":    len(items),
+			"rejected": len(items) - len(valid),
+			"warnings": nonNilWarnings(warnings),
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	for start := 0; start < len(valid); start += importBatchSize {
+		importBatch(r.Context(), prepared, valid[start:min(start+importBatchSize, len(valid))], results)
+	}
+
+	created := 0
+	for _, res := range results {
+		if res.ID != 0 {
+			created++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{
+		"created":  created,
+		"failed":   len(results) - created,
+		"results":  results,
+		"warnings": nonNilWarnings(warnings),
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// importBatch inserts the prepared checklists at the given indexes in one
+// transaction and fills in their results. When the transaction fails none
+// of them is imported.
+func importBatch(parent context.Context, prepared []newChecklist, batch []int, results []ImportResult) {
+	ctx, cancel := context.WithTimeout(parent, 8*time.Second)
+	defer cancel()
+
+	ids, rejected, err := insertImportBatch(ctx, prepared, batch)
+	if err != nil {
+		log.Printf("import batch error: %v", err)
+		for _, i := range batch {
+			results[i].Error = "not imported: database error"
+		}
+		return
+	}
+	for n, i := range batch {
+		if ids[n] == 0 {
+			results[i].Error, _ = importRejection(rejected[n])
+			continue
+		}
+		results[i].ID = ids[n]
+	}
+}
+
+// insertImportBatch returns the ids of the inserted checklists, 0 for those
+// that were rejected (a clientUuid that already exists, a duplicate of a
+// stored checklist or a wrong reference), together with the reasons.
+func insertImportBatch(ctx context.Context, prepared []newChecklist, batch []int) ([]int64, []error, error) {
+	var (
+		ids      []int64
+		rejected []error
+	)
+	err := inTx(ctx, nil, func(tx *sql.Tx) error {
+		ids, rejected = make([]int64, 0, len(batch)), make([]error, 0, len(batch))
+		for _, i := range batch {
+			id, err := insertImportedChecklist(ctx, tx, prepared[i])
+			if _, ok := importRejection(err); err != nil && !ok {
+				return err
+			}
+			ids = append(ids, id)
+			rejected = append(rejected, err)
+		}
+		// events last: appendEvent locks the event log until commit
+		for _, id := range ids {
+			if id == 0 {
+				continue
+			}
+			if err := appendEvent(ctx, tx, eventChecklistCreated, id, map[string]interface{}{"id": id, "source": "import"}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return ids, rejected, nil
+}
+
+// parseImportCSV reads checklists from a CSV file with a header row naming
+// the columns of the long export layout. Only key is required. Consecutive
+// rows with the same checklist_id form one checklist; without that column,
+// consecutive rows with the same child_name, date and specialist do.
+func parseImportCSV(r io.Reader) ([]importItem, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	col := make(map[string]int, len(header))
+	for i, h := range header {
+		col[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))] = i
+	}
+	if _, ok := col["key"]; !ok {
+		return nil, errors.New("header must contain a key column")
+	}
+
+	var (
+		items   []importItem
+		lastRef string
+	)
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		field := func(name string) string {
+			if i, ok := col[name]; ok && i < len(rec) {
+				return csvUnescape(rec[i])
+			}
+			return ""
+		}
+		optional := func(name string) *string {
+			if v := field(name); v != "" {
+				return &v
+			}
+			return nil
+		}
+
+		ref := field("checklist_id")
+		if _, ok := col["checklist_id"]; !ok {
+			ref = strings.Join([]string{field("child_name"), field("date"), field("specialist")}, "\x00")
+		}
+		if len(items) == 0 || ref != lastRef {
+			c := Checklist{
+				ChildName:  optional("child_name"),
+				Date:       optional("date"),
+				Specialist: optional("specialist"),
+				CreatedAt:  optional("created_at"),
+				ClientUUID: optional("client_uuid"),
+			}
+			it := importItem{Index: len(items), Line: line, Checklist: c}
+			if _, ok := col["checklist_id"]; ok {
+				it.Ref = ref
+			}
+			items = append(items, it)
+			lastRef = ref
+		}
+		if field("key") == "" {
+			continue // a checklist without answers, as exported
+		}
+		cur := &items[len(items)-1]
+		cur.Checklist.Answers = append(cur.Checklist.Answers, Answer{
+			Key:     field("key"),
+			Label:   field("label"),
+			Value:   optional("value"),
+			Comment: optional("comment"),
+		})
+	}
+	return items, nil
+}
+
+// csvUnescape reverses csvSafe, so exported files import unchanged.
+func csvUnescape(v string) string {
+	if len(v) > 1 && v[0] == '\'' && strings.ContainsRune("=+-@\t\r", rune(v[1])) {
+		return v[1:]
+	}
+	return v
+}
+
+func tooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
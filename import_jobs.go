@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Import job states.
+const (
+	importJobPending = "pending"
+	importJobRunning = "running"
+	importJobDone    = "done"
+)
+
+const (
+	// importChunkTimeout is the deadline of one import chunk transaction, the
+	// same as for interactive requests.
+	importChunkTimeout = 8 * time.Second
+
+	// importJobPoll is how often the worker looks for unfinished jobs that
+	// were not handed to it directly, e.g. after a restart.
+	importJobPoll = 30 * time.Second
+)
+
+// importBatchSize is the number of checklists per import transaction
+// (IMPORT_BATCH_SIZE). Import jobs adapt it to the chunk deadline.
+var importBatchSize = 100
+
+// importJobsWake starts the import worker right away when a job is created.
+var importJobsWake = make(chan struct{}, 1)
+
+// errImportJobBusy means another server instance is working on the job.
+var errImportJobBusy = errors.New("import job is being processed elsewhere")
+
+// ImportJob is the progress of an asynchronous import.
+type ImportJob struct {
+	ID        int64          `json:"id"`
+	Status    string         `json:"status"`
+	Total     int            `json:"total"`
+	Processed int            `json:"processed"`
+	Created   int            `json:"created"`
+	Failed    int            `json:"failed"`
+	Results   []ImportResult `json:"results"`
+	CreatedAt time.Time      `json:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+}
+
+// startImportJobs reads IMPORT_BATCH_SIZE and starts the worker running
+// import jobs. Jobs interrupted by a restart continue from their last
+// committed chunk.
+func startImportJobs() {
+	if v := os.Getenv("IMPORT_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 10000 {
+			log.Fatalf("IMPORT_BATCH_SIZE must be an integer between 1 and 10000, got %q", v)
+		}
+		importBatchSize = n
+	}
+
+	go func() {
+		for {
+			ids, err := unfinishedImportJobs()
+			if err != nil {
+				log.Printf("import jobs error: %v", err)
+			}
+			for _, id := range ids {
+				if err := runImportJob(id); err != nil && !errors.Is(err, errImportJobBusy) {
+					log.Printf("import job %d error: %v", id, err)
+				}
+			}
+			refreshImportGauges()
+			select {
+			case <-importJobsWake:
+			case <-time.After(importJobPoll):
+			}
+		}
+	}()
+}
+
+func unfinishedImportJobs() ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+	defer cancel()
+
+	var ids []int64
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT id FROM import_jobs WHERE status <> $1 ORDER BY id`, importJobDone)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		ids = nil
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return rows.Err()
+	})
+	return ids, err
+}
+
+// refreshImportGauges publishes the number of pending and running import
+// jobs and of the items they have left.
+func refreshImportGauges() {
+	ctx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+	defer cancel()
+
+	var pending, running, remaining int64
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, `
+SELECT count(*) FILTER (WHERE status = $1), count(*) FILTER (WHERE status = $2), COALESCE(sum(total - processed), 0)
+FROM import_jobs WHERE status <> $3`, importJobPending, importJobRunning, importJobDone).Scan(&pending, &running, &remaining)
+	})
+	if err != nil {
+		log.Printf("import gauges error: %v", err)
+		return
+	}
+	importJobsPending.Set(pending)
+	importJobsRunning.Set(running)
+	importItemsRemaining.Set(remaining)
+}
+
+// createImportJob stores the valid items of an import for the worker and
+// the results of the invalid ones, and wakes the worker.
+func createImportJob(ctx context.Context, items []importItem, results []ImportResult, valid []int) (int64, error) {
+	payload := make([]string, len(valid))
+	for n, i := range valid {
+		data, err := json.Marshal(items[i])
+		if err != nil {
+			return 0, err
+		}
+		payload[n] = string(data)
+	}
+	rejected := []ImportResult{}
+	for _, res := range results {
+		if res.Error != "" {
+			rejected = append(rejected, res)
+		}
+	}
+	rejectedJSON, err := json.Marshal(rejected)
+	if err != nil {
+		return 0, err
+	}
+
+	status := importJobPending
+	if len(valid) == 0 {
+		status = importJobDone
+	}
+	var id int64
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `
+INSERT INTO import_jobs (status, total, processed, failed, results, org_id)
+VALUES ($1, $2, $3, $3, $4, $5) RETURNING id`,
+			status, len(items), len(rejected), string(rejectedJSON), orgFrom(ctx)).Scan(&id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+INSERT INTO import_job_items (job_id, position, item)
+SELECT $1, t.ord - 1, t.item::jsonb FROM unnest($2::text[]) WITH ORDINALITY AS t(item, ord)`,
+			id, pq.Array(payload))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case importJobsWake <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// runImportJob imports the remaining items of a job chunk by chunk. Each
+// chunk commits its checklists together with the job progress, so a job
+// interrupted at any point resumes without losing or duplicating rows. The
+// chunk size is halved when a chunk comes close to its deadline or fails,
+// down to single items, and grows back while chunks are fast; a single item
+// that still fails is reported as failed and skipped.
+func runImportJob(id int64) error {
+	batch := importBatchSize
+	for {
+		start := time.Now()
+		done, err := runImportChunk(id, batch)
+		elapsed := time.Since(start)
+		refreshImportGauges()
+		switch {
+		case errors.Is(err, errImportJobBusy):
+			return err
+		case err != nil && batch > 1:
+			log.Printf("import job %d: chunk of %d failed, retrying smaller: %v", id, batch, err)
+			batch /= 2
+			continue
+		case err != nil:
+			log.Printf("import job %d: item failed: %v", id, err)
+			if err := skipImportItem(id, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if done {
+			return nil
+		}
+		if elapsed > importChunkTimeout/2 && batch > 1 {
+			batch /= 2
+		} else if elapsed < importChunkTimeout/8 && batch < importBatchSize {
+			batch = min(batch*2, importBatchSize)
+		}
+	}
+}
+
+// lockImportJob locks an unfinished job for a chunk transaction and returns
+// the position of its next item, its creation time and the organization the
+// job imports into. It returns
+// errImportJobBusy while another instance holds the job and sql.ErrNoRows
+// once the job is done.
+func lockImportJob(ctx context.Context, tx *sql.Tx, id int64) (int, time.Time, int64, error) {
+	var (
+		status    string
+		position  int
+		createdAt time.Time
+		org       int64
+	)
+	err := tx.QueryRowContext(ctx,
+		`SELECT status, next_position, created_at, org_id FROM import_jobs WHERE id = $1 FOR UPDATE SKIP LOCKED`,
+		id).Scan(&status, &position, &createdAt, &org)
+	if errors.Is(err, sql.ErrNoRows) {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM import_jobs WHERE id = $1)`, id).Scan(&exists); err != nil {
+			return 0, createdAt, 0, err
+		}
+		if exists {
+			return 0, createdAt, 0, errImportJobBusy
+		}
+		return 0, createdAt, 0, sql.ErrNoRows
+	}
+	if err == nil && status == importJobDone {
+		err = sql.ErrNoRows
+	}
+	return position, createdAt, org, err
+}
+
+func loadImportItems(ctx context.Context, tx *sql.Tx, id int64, position, limit int) ([]importItem, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT item FROM import_job_items WHERE job_id = $1 AND position >= $2 ORDER BY position LIMIT $3`,
+		id, position, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []importItem
+	for rows.Next() {
+		var (
+			data []byte
+			it   importItem
+		)
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &it); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// recordImportProgress advances the job past the given results within the
+// chunk transaction and reports whether the job is complete. The items of a
+// complete job are dropped.
+func recordImportProgress(ctx context.Context, tx *sql.Tx, id int64, results []ImportResult) (bool, error) {
+	created := 0
+	for _, res := range results {
+		if res.Error == "" {
+			created++
+		}
+	}
+	data, err := json.Marshal(results)
+	if err != nil {
+		return false, err
+	}
+
+	var status string
+	err = tx.QueryRowContext(ctx, `
+UPDATE import_jobs SET
+  next_position = next_position + $2,
+  processed = processed + $2,
+  created = created + $3,
+  failed = failed + $2 - $3,
+  results = results || $4::jsonb,
+  status = CASE WHEN processed + $2 >= total THEN 'done' ELSE 'running' END,
+  updated_at = now()
+WHERE id = $1
+RETURNING status`, id, len(results), created, string(data)).Scan(&status)
+	if err != nil {
+		return false, err
+	}
+	if status != importJobDone {
+		return false, nil
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM import_job_items WHERE job_id = $1`, id)
+	return true, err
+}
+
+// skipImportItem reports the next item of a job as failed with cause, after
+// it failed to import even on its own.
+func skipImportItem(id int64, cause error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), importChunkTimeout)
+	defer cancel()
+
+	return inTx(ctx, nil, func(tx *sql.Tx) error {
+		position, _, _, err := lockImportJob(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		items, err := loadImportItems(ctx, tx, id, position, 1)
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			return fmt.Errorf("import job %d has no item at position %d: %w", id, position, cause)
+		}
+		it := items[0]
+		res := ImportResult{Index: it.Index, Ref: it.Ref, Line: it.Line, Error: "not imported: database error"}
+		if errors.Is(cause, context.DeadlineExceeded) {
+			res.Error = "not imported: timed out"
+		}
+		_, err = recordImportProgress(ctx, tx, id, []ImportResult{res})
+		return err
+	})
+}
+
+// runImportChunk imports up to batch items of job id in one transaction and
+// reports whether the job is complete.
+func runImportChunk(id int64, batch int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), importChunkTimeout)
+	defer cancel()
+
+	done, err := importChunk(ctx, id, batch)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil // finished meanwhile
+	}
+	if err != nil && ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	return done, err
+}
+
+func importChunk(ctx context.Context, id int64, batch int) (bool, error) {
+	var done bool
+	err := inTx(ctx, nil, func(tx *sql.Tx) error {
+		position, receivedAt, org, err := lockImportJob(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		// the worker runs outside any request: act for the job's organization
+		ctx := withOrg(ctx, org)
+
+		items, err := loadImportItems(ctx, tx, id, position, batch)
+		if err != nil {
+			return err
+		}
+
+		results := make([]ImportResult, 0, len(items))
+		var ids []int64
+		for _, it := range items {
+			res := ImportResult{Index: it.Index, Ref: it.Ref, Line: it.Line}
+			nc, ws, err := prepareNewChecklist(it.Checklist, receivedAt, true)
+			if err != nil {
+				res.Error = err.Error()
+				results = append(results, res)
+				continue
+			}
+			res.ID, err = insertImportedChecklist(ctx, tx, nc)
+			if msg, rejected := importRejection(err); rejected {
+				res.ID, res.Error = 0, msg
+				results = append(results, res)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			res.Warnings = ws
+			ids = append(ids, res.ID)
+			results = append(results, res)
+		}
+		for _, cid := range ids {
+			if err := appendEvent(ctx, tx, eventChecklistCreated, cid, map[string]interface{}{"id": cid, "source": "import", "jobId": id}); err != nil {
+				return err
+			}
+		}
+
+		done, err = recordImportProgress(ctx, tx, id, results)
+		return err
+	})
+	return done, err
+}
+
+// importJobHandler handles GET /api/checklist/import/{id}: the progress of
+// an asynchronous import and the results so far, in file order.
+func importJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid import job id")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var (
+		job     = ImportJob{ID: id}
+		results []byte
+	)
+	err = inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, `
+SELECT status, total, processed, created, failed, results, created_at, updated_at
+FROM import_jobs WHERE id = $1 AND org_id = $2`, id, orgFrom(ctx)).Scan(
+			&job.Status, &job.Total, &job.Processed, &job.Created, &job.Failed, &results, &job.CreatedAt, &job.UpdatedAt)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "import job not found")
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(results, &job.Results)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load import job")
+		log.Printf("load import job %d error: %v", id, err)
+		return
+	}
+	sort.Slice(job.Results, func(i, j int) bool { return job.Results[i].Index < job.Results[j].Index })
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// writeJournalEnabled turns on the write journal (WRITE_JOURNAL=1), a debug
+// mode for analysing failed or slow writes under concurrency.
+var writeJournalEnabled bool
+
+type journalKey struct{}
+
+// journalEntry collects what a write request did in the database. appendEvent
+// fills in the transactions, writeErrorDetails the error sent to the client.
+type journalEntry struct {
+	txIDs      []int64
+	backendPID int
+	lockWait   time.Duration
+	errCode    string
+	errMessage string
+}
+
+func journalFrom(ctx context.Context) *journalEntry {
+	e, _ := ctx.Value(journalKey{}).(*journalEntry)
+	return e
+}
+
+// configureWriteJournal reads WRITE_JOURNAL.
+func configureWriteJournal() {
+	v := os.Getenv("WRITE_JOURNAL")
+	if v == "" {
+		return
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("WRITE_JOURNAL must be a boolean, got %q", v)
+	}
+	writeJournalEnabled = on
+	if on {
+		log.Printf("write journal enabled: every write request is recorded in write_journal")
+	}
+}
+
+// statusWriter remembers the response status.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// writeJournalMiddleware records every POST, PUT, PATCH and DELETE request in
+// write_journal: its timing, the ids of the transactions it committed or
+// tried to commit, the Postgres backend that ran them, the time spent waiting
+// for the event log lock and the error returned to the client.
+func writeJournalMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		e := &journalEntry{}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), journalKey{}, e)))
+		duration := time.Since(start)
+
+		// written off the request path so journaling does not slow it down
+		go func(id, method, path string, status int) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err := db.ExecContext(ctx, `
+INSERT INTO write_journal (request_id, method, path, status, tx_ids, backend_pid,
+                           started_at, duration_ms, lock_wait_ms, error_code, error_message)
+VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0), $7, $8, $9, NULLIF($10, ''), NULLIF($11, ''))`,
+				id, method, path, status, pq.Array(e.txIDs), e.backendPID,
+				start, float64(duration.Microseconds())/1000, float64(e.lockWait.Microseconds())/1000,
+				e.errCode, e.errMessage)
+			if err != nil {
+				log.Printf("write journal error: %v", err)
+			}
+		}(requestID(r), r.Method, r.URL.Path, sw.status)
+	})
+}
+
+// journalTx records the current transaction of a journaled request.
+func journalTx(ctx context.Context, q queryer, e *journalEntry) {
+	var txID int64
+	if err := q.QueryRowContext(ctx, `SELECT txid_current(), pg_backend_pid()`).Scan(&txID, &e.backendPID); err != nil {
+		log.Printf("write journal: read txid error: %v", err)
+		return
+	}
+	e.txIDs = append(e.txIDs, txID)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// defaultMaxInflight is twice the DB pool size: enough to keep the pool busy
+// without letting requests pile up behind it.
+const defaultMaxInflight = 50
+
+var (
+	inflightRequests = expvar.NewInt("http_inflight")
+	rejectedRequests = expvar.NewInt("http_rejected")
+
+	// the import job queue of all instances, refreshed by the import worker
+	importJobsPending    = expvar.NewInt("import_jobs_pending")
+	importJobsRunning    = expvar.NewInt("import_jobs_running")
+	importItemsRemaining = expvar.NewInt("import_items_remaining")
+)
+
+// inflightLimitMiddleware rejects requests with 503 once MAX_INFLIGHT_REQUESTS
+// are already being served (0 disables the limit). Long-poll requests mostly
+// sleep without holding a DB connection and are not counted.
+func inflightLimitMiddleware(next http.Handler) http.Handler {
+	limit := defaultMaxInflight
+	if v := os.Getenv("MAX_INFLIGHT_REQUESTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("MAX_INFLIGHT_REQUESTS must be a non-negative integer, got %q", v)
+		}
+		limit = n
+	}
+	if limit == 0 {
+		return next
+	}
+
+	sem := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/events/poll" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case sem <- struct{}{}:
+		default:
+			rejectedRequests.Add(1)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, codeUnavailable, "server is busy, retry later")
+			return
+		}
+		inflightRequests.Add(1)
+		defer func() {
+			inflightRequests.Add(-1)
+			<-sem
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
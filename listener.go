@@ -0,0 +1,18 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+)
+
+// listen opens the TCP listener for the HTTP server. When REUSEPORT is set the
+// socket is bound with SO_REUSEPORT, so a freshly started binary can accept
+// connections on the same port while the old process drains and exits.
+func listen(addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if os.Getenv("REUSEPORT") != "" {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
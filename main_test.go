@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// testDB points db at the database TEST_PG_DSN, with the schema prepared,
+// and skips the test when it is not set. Tests share the database, so they
+// create their own rows under unique names.
+func testDB(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv("TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TEST_PG_DSN is not set")
+	}
+	pool, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prepareSchema(pool); err != nil {
+		pool.Close()
+		t.Fatalf("prepare schema: %v", err)
+	}
+	prev := db
+	db = pool
+	t.Cleanup(func() {
+		db = prev
+		pool.Close()
+	})
+}
+
+// testAuth turns authentication on for the duration of the test.
+func testAuth(t *testing.T) {
+	t.Helper()
+	prevEnabled, prevSecret := authEnabled, jwtSecret
+	authEnabled, jwtSecret = true, []byte("test-secret-test-secret-test-secret")
+	t.Cleanup(func() { authEnabled, jwtSecret = prevEnabled, prevSecret })
+}
+
+// uniqueName returns prefix followed by random hex digits.
+func uniqueName(prefix string) string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// postJSON posts body to handler and returns the recorded response.
+func postJSON(t *testing.T, handler http.HandlerFunc, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b)))
+	return rec
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	maintenanceCheckPeriod = 10 * time.Minute
+
+	// maintenanceLockID is the advisory lock key letting one instance at a
+	// time run the maintenance job.
+	maintenanceLockID = 0x6d61696e74 // "maint"
+
+	// An index is worth rebuilding once it is larger than reindexMinBytes
+	// and reindexBloatRatio times its estimated compact size.
+	reindexMinBytes   = 8 << 20
+	reindexBloatRatio = 2.0
+)
+
+// maintenanceTables are vacuumed and analyzed by the maintenance job: the
+// tables written to all day.
+var maintenanceTables = []string{"checklists", "answers", "events", "children", "specialists", "refresh_tokens", "import_job_items"}
+
+// maintenanceWindow is a daily period of server local time, e.g. 02:00-04:00;
+// it may span midnight.
+type maintenanceWindow struct {
+	from, length time.Duration
+	text         string
+}
+
+var (
+	maintenance      *maintenanceWindow // nil when the job is off
+	maintenanceApply bool               // MAINTENANCE_REINDEX
+
+	maintenanceMu      sync.Mutex
+	maintenanceOpened  time.Time // start of the last window the job ran in
+	maintenanceLastRun *MaintenanceRun
+)
+
+// MaintenanceRun is the outcome of the last maintenance run of this instance.
+type MaintenanceRun struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Vacuumed   []string  `json:"vacuumed"`
+	Reindexed  []string  `json:"reindexed"`
+	Errors     []string  `json:"errors"`
+}
+
+// TableHealth shows how many dead rows a table carries and when it was last
+// vacuumed and analyzed, by the job or by autovacuum.
+type TableHealth struct {
+	Name        string     `json:"name"`
+	LiveRows    int64      `json:"liveRows"`
+	DeadRows    int64      `json:"deadRows"`
+	DeadRatio   float64    `json:"deadRatio"`
+	LastVacuum  *time.Time `json:"lastVacuum"`
+	LastAnalyze *time.Time `json:"lastAnalyze"`
+}
+
+// IndexHealth shows the size and use of an index. EstimatedBytes is a rough
+// size of the b-tree rebuilt from scratch; Recommendation is "reindex" for
+// a bloated index and "unused" for a non-unique one never scanned since the
+// statistics were reset.
+type IndexHealth struct {
+	Name           string  `json:"name"`
+	Table          string  `json:"table"`
+	Bytes          int64   `json:"bytes"`
+	EstimatedBytes int64   `json:"estimatedBytes"`
+	BloatRatio     float64 `json:"bloatRatio"`
+	Scans          int64   `json:"scans"`
+	Unique         bool    `json:"unique"`
+	Recommendation string  `json:"recommendation,omitempty"`
+}
+
+// parseMaintenanceWindow parses "HH:MM-HH:MM".
+func parseMaintenanceWindow(v string) (*maintenanceWindow, error) {
+	from, to, ok := strings.Cut(v, "-")
+	if !ok {
+		return nil, fmt.Errorf("%q must be HH:MM-HH:MM", v)
+	}
+	f, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return nil, fmt.Errorf("%q must be HH:MM-HH:MM", v)
+	}
+	t, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return nil, fmt.Errorf("%q must be HH:MM-HH:MM", v)
+	}
+	start := time.Duration(f.Hour())*time.Hour + time.Duration(f.Minute())*time.Minute
+	end := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	length := (end - start + 24*time.Hour) % (24 * time.Hour)
+	if length == 0 {
+		return nil, fmt.Errorf("%q must not start and end at the same time", v)
+	}
+	return &maintenanceWindow{from: start, length: length, text: v}, nil
+}
+
+// openedAt returns the start of the latest window starting at or before t
+// and whether t falls within it.
+func (w maintenanceWindow) openedAt(t time.Time) (time.Time, bool) {
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Add(w.from)
+	if start.After(t) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start, t.Before(start.Add(w.length))
+}
+
+// startMaintenance runs the maintenance job once per MAINTENANCE_WINDOW:
+// VACUUM (ANALYZE) of the busy tables and, with MAINTENANCE_REINDEX=1, a
+// concurrent rebuild of bloated indexes. Without MAINTENANCE_REINDEX the
+// indexes are only recommended for a rebuild in the log and in
+// GET /api/admin/maintenance. Without MAINTENANCE_WINDOW the job is off.
+func startMaintenance() {
+	if v := os.Getenv("MAINTENANCE_REINDEX"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("MAINTENANCE_REINDEX must be a boolean, got %q", v)
+		}
+		maintenanceApply = on
+	}
+	v := os.Getenv("MAINTENANCE_WINDOW")
+	if v == "" {
+		return
+	}
+	w, err := parseMaintenanceWindow(v)
+	if err != nil {
+		log.Fatalf("invalid MAINTENANCE_WINDOW: %v", err)
+	}
+	maintenance = w
+
+	go func() {
+		for {
+			now := time.Now()
+			if start, open := w.openedAt(now); open {
+				maintenanceMu.Lock()
+				due := maintenanceOpened.Before(start)
+				if due {
+					maintenanceOpened = start
+				}
+				maintenanceMu.Unlock()
+				if due {
+					runMaintenance(start.Add(w.length))
+				}
+			}
+			time.Sleep(maintenanceCheckPeriod)
+		}
+	}()
+}
+
+// runMaintenance runs the job until the window closes at deadline. VACUUM
+// and REINDEX CONCURRENTLY cannot run in a transaction, so it works on one
+// connection holding the advisory lock.
+func runMaintenance(deadline time.Time) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		log.Printf("maintenance error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, maintenanceLockID).Scan(&locked); err != nil {
+		log.Printf("maintenance error: %v", err)
+		return
+	}
+	if !locked {
+		return // another instance runs it
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, maintenanceLockID)
+
+	run := &MaintenanceRun{StartedAt: time.Now(), Vacuumed: []string{}, Reindexed: []string{}, Errors: []string{}}
+	for _, table := range maintenanceTables {
+		if _, err := conn.ExecContext(ctx, `VACUUM (ANALYZE) `+pq.QuoteIdentifier(table)); err != nil {
+			run.Errors = append(run.Errors, fmt.Sprintf("vacuum %s: %v", table, err))
+			continue
+		}
+		run.Vacuumed = append(run.Vacuumed, table)
+	}
+
+	indexes, err := indexHealth(ctx)
+	if err != nil {
+		run.Errors = append(run.Errors, fmt.Sprintf("index health: %v", err))
+	}
+	for _, idx := range indexes {
+		if idx.Recommendation != "reindex" {
+			continue
+		}
+		if !maintenanceApply {
+			log.Printf("maintenance: index %s is %d bytes, about %.1f times its compact size; consider REINDEX",
+				idx.Name, idx.Bytes, idx.BloatRatio)
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, `REINDEX INDEX CONCURRENTLY `+pq.QuoteIdentifier(idx.Name)); err != nil {
+			run.Errors = append(run.Errors, fmt.Sprintf("reindex %s: %v", idx.Name, err))
+			continue
+		}
+		run.Reindexed = append(run.Reindexed, idx.Name)
+	}
+	run.FinishedAt = time.Now()
+
+	for _, e := range run.Errors {
+		log.Printf("maintenance error: %s", e)
+	}
+	log.Printf("maintenance: vacuumed %d tables, reindexed %d indexes in %s",
+		len(run.Vacuumed), len(run.Reindexed), run.FinishedAt.Sub(run.StartedAt).Round(time.Second))
+
+	maintenanceMu.Lock()
+	maintenanceLastRun = run
+	maintenanceMu.Unlock()
+}
+
+func tableHealth(ctx context.Context) ([]TableHealth, error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT relname, n_live_tup, n_dead_tup,
+       GREATEST(last_vacuum, last_autovacuum), GREATEST(last_analyze, last_autoanalyze)
+FROM pg_stat_user_tables
+WHERE schemaname = current_schema() AND relname = ANY($1)
+ORDER BY n_dead_tup DESC, relname`, pq.Array(maintenanceTables))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := []TableHealth{}
+	for rows.Next() {
+		var (
+			t               TableHealth
+			vacuum, analyze sql.NullTime
+		)
+		if err := rows.Scan(&t.Name, &t.LiveRows, &t.DeadRows, &vacuum, &analyze); err != nil {
+			return nil, err
+		}
+		if n := t.LiveRows + t.DeadRows; n > 0 {
+			t.DeadRatio = float64(t.DeadRows) / float64(n)
+		}
+		t.LastVacuum, t.LastAnalyze = timePtr(vacuum), timePtr(analyze)
+		tables = append(tables, t)
+	}
+	return tables, rows.Err()
+}
+
+// indexHealth lists the b-tree indexes of the schema, largest first. The
+// compact size is estimated from the row count and the average width of
+// the indexed columns (pg_stats) with the per-entry overhead and the
+// default 90% fill factor, which is enough to tell a bloated index from a
+// healthy one.
+func indexHealth(ctx context.Context) ([]IndexHealth, error) {
+	rows, err := db.QueryContext(ctx, `
+WITH idx AS (
+  SELECT ic.relname AS name, tc.relname AS tbl, pg_relation_size(i.indexrelid) AS bytes,
+         GREATEST(ic.reltuples, 0) AS tuples, i.indisunique AS uniq,
+         COALESCE(s.idx_scan, 0) AS scans,
+         (SELECT COALESCE(sum(st.avg_width), 8) FROM pg_attribute a
+          JOIN pg_stats st ON st.schemaname = n.nspname AND st.tablename = tc.relname AND st.attname = a.attname
+          WHERE a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)) AS width
+  FROM pg_index i
+  JOIN pg_class ic ON ic.oid = i.indexrelid
+  JOIN pg_class tc ON tc.oid = i.indrelid
+  JOIN pg_namespace n ON n.oid = tc.relnamespace
+  JOIN pg_am am ON am.oid = ic.relam
+  LEFT JOIN pg_stat_user_indexes s ON s.indexrelid = i.indexrelid
+  WHERE n.nspname = current_schema() AND am.amname = 'btree'
+)
+SELECT name, tbl, bytes, (ceil(tuples * (width + 16) / (8192 * 0.9)) + 1) * 8192, scans, uniq
+FROM idx
+ORDER BY bytes DESC, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	indexes := []IndexHealth{}
+	for rows.Next() {
+		var idx IndexHealth
+		if err := rows.Scan(&idx.Name, &idx.Table, &idx.Bytes, &idx.EstimatedBytes, &idx.Scans, &idx.Unique); err != nil {
+			return nil, err
+		}
+		if idx.EstimatedBytes > 0 {
+			idx.BloatRatio = float64(idx.Bytes) / float64(idx.EstimatedBytes)
+		}
+		switch {
+		case idx.Bytes > reindexMinBytes && idx.BloatRatio > reindexBloatRatio:
+			idx.Recommendation = "reindex"
+		case idx.Scans == 0 && !idx.Unique:
+			idx.Recommendation = "unused"
+		}
+		indexes = append(indexes, idx)
+	}
+	return indexes, rows.Err()
+}
+
+// maintenanceHandler handles GET /api/admin/maintenance: dead rows of the
+// busy tables, size, bloat and use of the indexes, and the last run of the
+// maintenance job on this instance. Like the storage report it covers the
+// whole database.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !isOperator(r.Context()) {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "maintenance is reported to the administrators of the first organization")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	tables, err := tableHealth(ctx)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to read table statistics")
+		log.Printf("table health error: %v", err)
+		return
+	}
+	indexes, err := indexHealth(ctx)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to read index statistics")
+		log.Printf("index health error: %v", err)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"window":  nil,
+		"reindex": maintenanceApply,
+		"tables":  tables,
+		"indexes": indexes,
+	}
+	if maintenance != nil {
+		resp["window"] = maintenance.text
+	}
+	maintenanceMu.Lock()
+	resp["lastRun"] = maintenanceLastRun
+	maintenanceMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenID Connect login (authorization code flow with PKCE) against the
+// identity provider OIDC_ISSUER. The IdP's groups decide the role; accounts
+// are linked to specialists by the subject claim, and on first login by a
+// verified email within OIDC_ORGANIZATION.
+const (
+	oidcCookie       = "oidc_login"
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+type oidcConfig struct {
+	issuer, clientID, clientSecret string
+	redirectURL, postLoginURL      string
+	scopes, groupsClaim            string
+	roleGroups                     map[string][]string // role -> IdP groups
+	org                            int64               // organization of accounts created at login
+	client                         *http.Client
+
+	mu        sync.Mutex
+	authURL   string // from discovery
+	tokenURL  string
+	discovery time.Time
+}
+
+// oidc is nil when OIDC_ISSUER is not set.
+var oidc *oidcConfig
+
+// configureOIDC reads OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET,
+// OIDC_REDIRECT_URL, OIDC_ORGANIZATION and the group mapping. It needs authentication on, as
+// an OIDC login ends with the server's own tokens.
+func configureOIDC() {
+	issuer := strings.TrimRight(os.Getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return
+	}
+	if !authEnabled {
+		log.Fatal("OIDC_ISSUER requires JWT_SECRET")
+	}
+	c := &oidcConfig{
+		issuer:       issuer,
+		clientID:     os.Getenv("OIDC_CLIENT_ID"),
+		clientSecret: secretEnv("OIDC_CLIENT_SECRET"),
+		redirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		postLoginURL: os.Getenv("OIDC_POST_LOGIN_URL"),
+		scopes:       os.Getenv("OIDC_SCOPES"),
+		groupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		roleGroups:   map[string][]string{},
+		org:          defaultOrgID,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+	if v := os.Getenv("OIDC_ORGANIZATION"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			log.Fatalf("OIDC_ORGANIZATION must be an organization id, got %q", v)
+		}
+		c.org = n
+	}
+	if c.clientID == "" || c.redirectURL == "" {
+		log.Fatal("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required with OIDC_ISSUER")
+	}
+	if c.postLoginURL == "" {
+		c.postLoginURL = "/"
+	}
+	if c.scopes == "" {
+		c.scopes = "openid profile email"
+	}
+	if c.groupsClaim == "" {
+		c.groupsClaim = "groups"
+	}
+	for _, role := range []string{roleAdmin, roleSpecialist, roleViewer} {
+		env := "OIDC_" + strings.ToUpper(role) + "_GROUPS"
+		for _, g := range strings.Split(os.Getenv(env), ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				c.roleGroups[role] = append(c.roleGroups[role], g)
+			}
+		}
+	}
+	if len(c.roleGroups) == 0 {
+		log.Fatal("at least one of OIDC_ADMIN_GROUPS, OIDC_SPECIALIST_GROUPS and OIDC_VIEWER_GROUPS is required with OIDC_ISSUER")
+	}
+	oidc = c
+	publicPaths["/api/auth/oidc/login"] = true
+	publicPaths["/api/auth/oidc/callback"] = true
+	log.Printf("OIDC login enabled with issuer %s", issuer)
+}
+
+// endpoints returns the authorization and token endpoints from the issuer's
+// discovery document, fetched on first use and again after an hour.
+func (c *oidcConfig) endpoints(ctx context.Context) (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.authURL != "" && time.Since(c.discovery) < time.Hour {
+		return c.authURL, c.tokenURL, nil
+	}
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("oidc discovery: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", "", fmt.Errorf("oidc discovery: %w", err)
+	}
+	if strings.TrimRight(doc.Issuer, "/") != c.issuer || doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" {
+		return "", "", errors.New("oidc discovery: issuer mismatch or missing endpoints")
+	}
+	c.authURL, c.tokenURL, c.discovery = doc.AuthorizationEndpoint, doc.TokenEndpoint, time.Now()
+	return c.authURL, c.tokenURL, nil
+}
+
+// oidcLoginState is kept in a signed cookie between the redirect to the IdP
+// and the callback.
+type oidcLoginState struct {
+	State     string `json:"state"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// oidcLoginHandler handles GET /api/auth/oidc/login: it redirects the
+// browser to the identity provider.
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if oidc == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "OIDC login is not configured")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+	authURL, _, err := oidc.endpoints(ctx)
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, codeUnavailable, "identity provider is not reachable")
+		log.Printf("oidc discovery error: %v", err)
+		return
+	}
+
+	st := oidcLoginState{State: randomToken(), Nonce: randomToken(), Verifier: randomToken(),
+		ExpiresAt: time.Now().Add(oidcLoginTimeout).Unix()}
+	payload, _ := json.Marshal(st)
+	value := base64.RawURLEncoding.EncodeToString(payload)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    value + "." + jwtSignature(value),
+		Path:     "/api/auth/oidc/",
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(oidc.redirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidc.clientID},
+		"redirect_uri":          {oidc.redirectURL},
+		"scope":                 {oidc.scopes},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(authURL, "?") {
+		sep = "&"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, authURL+sep+q.Encode(), http.StatusFound)
+}
+
+// oidcCallbackPage stores the tokens where the frontend keeps them and
+// returns to it; opened in a popup, it just closes.
+var oidcCallbackPage = template.Must(template.New("callback").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Вход</title></head><body><script>
+localStorage.setItem('accessToken', {{.AccessToken}});
+localStorage.setItem('refreshToken', {{.RefreshToken}});
+if (window.opener) { window.close(); } else { location.replace({{.Next}}); }
+</script></body></html>`))
+
+// oidcCallbackHandler handles GET /api/auth/oidc/callback: it exchanges the
+// authorization code, maps the IdP groups to a role, finds or creates the
+// specialist and issues the server's tokens.
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if oidc == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "OIDC login is not configured")
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "identity provider refused the login: "+e)
+		return
+	}
+	st, ok := readOIDCLoginState(r)
+	if !ok || q.Get("state") == "" || !hmac.Equal([]byte(q.Get("state")), []byte(st.State)) {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "login expired or was not started here; start it again")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/api/auth/oidc/", MaxAge: -1})
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	claims, err := oidc.exchange(ctx, q.Get("code"), st)
+	if err != nil {
+		writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "identity provider login failed")
+		log.Printf("oidc code exchange error: %v", err)
+		return
+	}
+	role := oidc.role(claims)
+	if role == "" {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "none of your groups gives access to this service")
+		log.Printf("oidc login of %q refused: no mapped group", claims.Subject)
+		return
+	}
+
+	var resp tokenResponse
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		id, org, login, err := oidcSpecialist(ctx, tx, claims, role)
+		if errors.Is(err, errSpecialistInactive) {
+			return newStatusError(http.StatusForbidden, codeForbidden, err.Error())
+		}
+		if err != nil {
+			return fmt.Errorf("oidc account: %w", err)
+		}
+		resp, err = issueTokens(ctx, tx, id, login, role, org)
+		return err
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to issue tokens")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = oidcCallbackPage.Execute(w, map[string]string{
+		"AccessToken": resp.AccessToken, "RefreshToken": resp.RefreshToken, "Next": oidc.postLoginURL,
+	})
+}
+
+func readOIDCLoginState(r *http.Request) (oidcLoginState, bool) {
+	var st oidcLoginState
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		return st, false
+	}
+	value, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(jwtSignature(value))) {
+		return st, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || json.Unmarshal(payload, &st) != nil {
+		return st, false
+	}
+	return st, time.Now().Unix() < st.ExpiresAt
+}
+
+// oidcClaims are the ID token claims used; groups are read separately
+// since their claim name is configurable.
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	ExpiresAt         int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	Name              string          `json:"name"`
+	PreferredUsername string          `json:"preferred_username"`
+	Email             string          `json:"email"`
+	EmailVerified     bool            `json:"email_verified"`
+	groups            []string
+}
+
+// exchange redeems the authorization code at the token endpoint and returns
+// the validated ID token claims. The ID token comes straight from the token
+// endpoint over TLS, so (as OpenID Connect Core 3.1.3.7 allows) its issuer
+// is trusted from the connection rather than from a signature check.
+func (c *oidcConfig) exchange(ctx context.Context, code string, st oidcLoginState) (oidcClaims, error) {
+	var claims oidcClaims
+	if code == "" {
+		return claims, errors.New("no authorization code")
+	}
+	_, tokenURL, err := c.endpoints(ctx)
+	if err != nil {
+		return claims, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.redirectURL},
+		"code_verifier": {st.Verifier},
+		"client_id":     {c.clientID},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return claims, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if c.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return claims, err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return claims, fmt.Errorf("token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return claims, fmt.Errorf("token endpoint: %s %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+
+	parts := strings.Split(body.IDToken, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed id_token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, fmt.Errorf("malformed id_token: %w", err)
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, fmt.Errorf("malformed id_token: %w", err)
+	}
+	if strings.TrimRight(claims.Issuer, "/") != c.issuer || claims.Subject == "" || !c.audienceOK(claims.Audience) {
+		return claims, errors.New("id_token is not for this client")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errors.New("id_token expired")
+	}
+	if !hmac.Equal([]byte(claims.Nonce), []byte(st.Nonce)) {
+		return claims, errors.New("id_token nonce mismatch")
+	}
+	var all map[string]json.RawMessage
+	_ = json.Unmarshal(payload, &all)
+	claims.groups = stringList(all[c.groupsClaim])
+	return claims, nil
+}
+
+// audienceOK checks aud, which is a string or an array of strings.
+func (c *oidcConfig) audienceOK(aud json.RawMessage) bool {
+	for _, a := range stringList(aud) {
+		if a == c.clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// stringList decodes a JSON string or array of strings.
+func stringList(raw json.RawMessage) []string {
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return list
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil && s != "" {
+		return []string{s}
+	}
+	return nil
+}
+
+// role returns the highest role granted by the user's groups, or "".
+func (c *oidcConfig) role(claims oidcClaims) string {
+	for _, role := range []string{roleAdmin, roleSpecialist, roleViewer} {
+		for _, g := range c.roleGroups[role] {
+			for _, have := range claims.groups {
+				if g == have {
+					return role
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// oidcSpecialist returns the specialist linked to the IdP subject, linking
+// one with the same verified email or creating one on first login, and
+// brings its role in line with the IdP groups. It returns the id, the
+// organization and the login of the specialist (see oidcLogin).
+func oidcSpecialist(ctx context.Context, tx *sql.Tx, claims oidcClaims, role string) (int64, int64, string, error) {
+	var (
+		id, org     int64
+		storedRole  string
+		deactivated sql.NullTime
+	)
+	err := tx.QueryRowContext(ctx, `SELECT id, org_id, role, deactivated_at FROM specialists WHERE oidc_subject = $1 FOR UPDATE`,
+		claims.Subject).Scan(&id, &org, &storedRole, &deactivated)
+	if errors.Is(err, sql.ErrNoRows) && claims.Email != "" && claims.EmailVerified {
+		err = tx.QueryRowContext(ctx, `
+UPDATE specialists SET oidc_subject = $2, updated_at = now()
+WHERE org_id = $3 AND email = $1 AND oidc_subject IS NULL
+RETURNING id, org_id, role, deactivated_at`, strings.ToLower(claims.Email), claims.Subject, oidc.org).Scan(&id, &org, &storedRole, &deactivated)
+	}
+	if err == nil {
+		ctx = withOrg(ctx, org)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		name := claims.Name
+		for _, n := range []string{claims.PreferredUsername, claims.Email, claims.Subject} {
+			if name == "" {
+				name = n
+			}
+		}
+		var email interface{}
+		if claims.Email != "" && claims.EmailVerified {
+			email = strings.ToLower(claims.Email)
+		}
+		// an email already linked to another subject is not copied
+		org, ctx = oidc.org, withOrg(ctx, oidc.org)
+		err = tx.QueryRowContext(ctx, `
+INSERT INTO specialists (org_id, name, email, oidc_subject, role)
+VALUES ($5, $1, CASE WHEN EXISTS (SELECT 1 FROM specialists WHERE org_id = $5 AND email = $2) THEN NULL ELSE $2 END, $3, $4)
+RETURNING id`, name, email, claims.Subject, role, org).Scan(&id)
+		if err != nil {
+			return 0, 0, "", fmt.Errorf("create specialist: %w", err)
+		}
+		if err := appendEvent(ctx, tx, eventSpecialistCreated, id, map[string]interface{}{"id": id, "oidc": true}); err != nil {
+			return 0, 0, "", err
+		}
+		storedRole = role
+	} else if err != nil {
+		return 0, 0, "", err
+	}
+	if deactivated.Valid {
+		return 0, 0, "", errSpecialistInactive
+	}
+	if storedRole != role {
+		if _, err := tx.ExecContext(ctx, `UPDATE specialists SET role = $2, updated_at = now() WHERE id = $1`, id, role); err != nil {
+			return 0, 0, "", err
+		}
+		if err := appendEvent(ctx, tx, eventSpecialistUpdated, id, map[string]interface{}{"id": id, "role": role}); err != nil {
+			return 0, 0, "", err
+		}
+	}
+	login, err := oidcLogin(ctx, tx, id, claims)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("set login: %w", err)
+	}
+	return id, org, login, nil
+}
+
+// oidcLogin returns the login of specialist id. An account without one,
+// such as one created at its first OIDC login, gets the IdP's
+// preferred_username or else the subject, followed by "-" and its id when
+// another account has that login already: refreshHandler only refreshes
+// the tokens of accounts with a login.
+func oidcLogin(ctx context.Context, tx *sql.Tx, id int64, claims oidcClaims) (string, error) {
+	login := strings.ToLower(strings.TrimSpace(claims.PreferredUsername))
+	if login == "" {
+		login = strings.ToLower(claims.Subject)
+	}
+	err := tx.QueryRowContext(ctx, `
+UPDATE specialists SET updated_at = now(),
+  login = CASE WHEN EXISTS (SELECT 1 FROM specialists WHERE login = $2 AND id <> $1) THEN $2 || '-' || id ELSE $2 END
+WHERE id = $1 AND login IS NULL
+RETURNING login`, id, login).Scan(&login)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.QueryRowContext(ctx, `SELECT login FROM specialists WHERE id = $1`, id).Scan(&login)
+	}
+	return login, err
+}
+
+// randomToken returns 32 random bytes, base64url encoded.
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// testIdP serves the discovery document and a token endpoint that issues an
+// ID token with the claims returned by claims.
+func testIdP(t *testing.T, claims func() map[string]interface{}) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := json.Marshal(claims())
+		token := "e30." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": token})
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+var refreshTokenInPage = regexp.MustCompile(`'refreshToken', "([^"]+)"`)
+
+// oidcTestLogin runs the login redirect and the callback and returns the
+// refresh token stored by the callback page. nonce receives the nonce sent
+// to the IdP before the callback runs.
+func oidcTestLogin(t *testing.T, nonce *string) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	oidcLoginHandler(rec, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login redirect: %d %s", rec.Code, rec.Body)
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	*nonce = loc.Query().Get("nonce")
+
+	req := httptest.NewRequest(http.MethodGet,
+		"/api/auth/oidc/callback?code=abc&state="+url.QueryEscape(loc.Query().Get("state")), nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	oidcCallbackHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("callback: %d %s", rec.Code, rec.Body)
+	}
+	m := refreshTokenInPage.FindStringSubmatch(rec.Body.String())
+	if m == nil {
+		t.Fatalf("no refresh token in the callback page: %s", rec.Body)
+	}
+	return m[1]
+}
+
+func TestOIDCLoginThenRefresh(t *testing.T) {
+	testDB(t)
+	testAuth(t)
+
+	subject, username := uniqueName("sub-"), uniqueName("oidc-")
+	var nonce, issuer string
+	idp := testIdP(t, func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss": issuer, "sub": subject, "aud": "app", "exp": time.Now().Add(time.Minute).Unix(),
+			"nonce": nonce, "name": "Петрова Анна", "preferred_username": username, "groups": []string{"staff"},
+		}
+	})
+	issuer = idp.URL
+
+	prev := oidc
+	oidc = &oidcConfig{
+		issuer: idp.URL, clientID: "app", redirectURL: "https://app.example/api/auth/oidc/callback",
+		postLoginURL: "/", scopes: "openid", groupsClaim: "groups",
+		roleGroups: map[string][]string{roleSpecialist: {"staff"}}, org: defaultOrgID, client: idp.Client(),
+	}
+	t.Cleanup(func() { oidc = prev })
+
+	for i := 0; i < 2; i++ {
+		token := oidcTestLogin(t, &nonce)
+		code, resp := refresh(t, token)
+		if code != http.StatusOK || resp.RefreshToken == "" {
+			t.Fatalf("refresh after OIDC login %d: %d", i+1, code)
+		}
+	}
+
+	var login string
+	if err := db.QueryRow(`SELECT login FROM specialists WHERE oidc_subject = $1`, subject).Scan(&login); err != nil {
+		t.Fatal(err)
+	}
+	if login != username {
+		t.Errorf("login = %q, want the preferred_username %q", login, username)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// defaultOrgID is the first organization. Data stored before organizations
+// existed belongs to it, requests without authentication act for it and its
+// admins manage the other organizations.
+const defaultOrgID int64 = 1
+
+const eventOrganizationCreated = "organization.created"
+
+// Organization is a tenant, e.g. one kindergarten. Checklists, children,
+// specialists, groups, import jobs, announcements and events belong to one
+// organization and are only visible within it.
+type Organization struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type organizationInput struct {
+	Name string `json:"name"`
+	// Admin is the first account of the organization; its admins then
+	// manage their specialists themselves.
+	Admin *struct {
+		Name     string `json:"name"`
+		Login    string `json:"login"`
+		Password string `json:"password"`
+	} `json:"admin"`
+}
+
+type orgKey struct{}
+
+// withOrg makes ctx act for organization org, for work done outside a
+// request, such as import jobs. Org 0 stands for the whole installation:
+// events recorded with it are shown in every organization.
+func withOrg(ctx context.Context, org int64) context.Context {
+	return context.WithValue(ctx, orgKey{}, org)
+}
+
+// orgFrom returns the organization the request or job acts for: the one set
+// with withOrg, else the one of the access token, else defaultOrgID.
+func orgFrom(ctx context.Context) int64 {
+	if org, ok := ctx.Value(orgKey{}).(int64); ok {
+		return org
+	}
+	if c := authFrom(ctx); c != nil {
+		return c.Org
+	}
+	return defaultOrgID
+}
+
+// isOperator reports whether the request may manage organizations: it is
+// made by an admin of the first organization or authentication is off.
+func isOperator(ctx context.Context) bool {
+	c := authFrom(ctx)
+	return c == nil || (c.Org == defaultOrgID && c.hasRole(roleAdmin))
+}
+
+// organizationsHandler handles GET (list) and POST (create) on
+// /api/admin/organizations.
+func organizationsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isOperator(r.Context()) {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "organizations are managed by the administrators of the first organization")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		listOrganizations(w, r)
+	case http.MethodPost:
+		createOrganization(w, r)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+func listOrganizations(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `SELECT id, name, created_at FROM organizations ORDER BY id`)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list organizations")
+		log.Printf("list organizations error: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	items := []Organization{}
+	for rows.Next() {
+		var o Organization
+		if err := rows.Scan(&o.ID, &o.Name, &o.CreatedAt); err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list organizations")
+			log.Printf("scan organization error: %v", err)
+			return
+		}
+		items = append(items, o)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list organizations")
+		log.Printf("list organizations error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+}
+
+// createOrganization creates an organization and, when given, its first
+// admin account.
+func createOrganization(w http.ResponseWriter, r *http.Request) {
+	var in organizationInput
+	warnings, err := decodeJSON(r.Body, &in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "name must be provided")
+		return
+	}
+	var (
+		name, login string
+		hash        []byte
+	)
+	if in.Admin != nil {
+		name, login = strings.TrimSpace(in.Admin.Name), strings.ToLower(strings.TrimSpace(in.Admin.Login))
+		if login == "" {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "admin.login must be provided")
+			return
+		}
+		if name == "" {
+			name = login
+		}
+		if len(in.Admin.Password) < minPasswordLength {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest,
+				fmt.Sprintf("admin.password must be at least %d characters long", minPasswordLength))
+			return
+		}
+		if hash, err = bcrypt.GenerateFromPassword([]byte(in.Admin.Password), bcrypt.DefaultCost); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "admin.password cannot be used")
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var (
+		o       Organization
+		adminID int64
+	)
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx,
+			`INSERT INTO organizations (name) VALUES ($1) ON CONFLICT (name) DO NOTHING RETURNING id, name, created_at`,
+			in.Name).Scan(&o.ID, &o.Name, &o.CreatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newStatusError(http.StatusConflict, codeConflict, "organization already exists")
+		}
+		if err != nil {
+			return fmt.Errorf("insert organization: %w", err)
+		}
+		payload := map[string]interface{}{"id": o.ID, "name": o.Name}
+		if in.Admin != nil {
+			if err := actForOrg(ctx, tx, o.ID); err != nil {
+				return err
+			}
+			err := tx.QueryRowContext(ctx,
+				`INSERT INTO specialists (org_id, name, login, password_hash, role) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+				o.ID, name, login, string(hash), roleAdmin).Scan(&adminID)
+			if isUniqueViolation(err) {
+				return newStatusError(http.StatusConflict, codeConflict, "login already exists")
+			}
+			if err != nil {
+				return fmt.Errorf("insert admin: %w", err)
+			}
+			payload["adminId"] = adminID
+			if err := actForOrg(ctx, tx, orgFrom(ctx)); err != nil {
+				return err
+			}
+		}
+		return appendEvent(ctx, tx, eventOrganizationCreated, o.ID, payload)
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to create organization")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	resp := map[string]interface{}{"organization": o, "warnings": nonNilWarnings(warnings)}
+	if adminID != 0 {
+		resp["adminId"] = adminID
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
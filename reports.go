@@ -0,0 +1,592 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	eventReportCreated = "report.created"
+	eventReportUpdated = "report.updated"
+	eventReportDeleted = "report.deleted"
+
+	defaultReportRows    = 1000
+	maxReportRows        = 10000
+	defaultReportTimeout = 10
+	maxReportTimeout     = 60
+)
+
+// reportTx runs reports: a read-only transaction refuses any write, whatever
+// the query calls.
+var reportTx = &sql.TxOptions{ReadOnly: true}
+
+var (
+	reportNamePattern  = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	reportParamPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+)
+
+// Report is a saved read-only query for the administrative requests the
+// API has no endpoint for. Reports are shared by all organizations: the
+// query refers to the caller's organization as :org and to its other
+// parameters as :name. Requiring :org does not make a query tenant-safe
+// (WHERE org_id = :org OR true passes); only in DB_RLS mode does the
+// database hide the rows of other organizations, and then only in the
+// tables under row-level security.
+type Report struct {
+	ID             int64         `json:"id"`
+	Name           string        `json:"name"`
+	Description    *string       `json:"description"`
+	Query          string        `json:"query"`
+	Params         []ReportParam `json:"params"`
+	MaxRows        int           `json:"maxRows"`
+	TimeoutSeconds int           `json:"timeoutSeconds"`
+	CreatedAt      time.Time     `json:"createdAt"`
+	UpdatedAt      time.Time     `json:"updatedAt"`
+}
+
+// ReportParam is a parameter of a report, given in the query string when it
+// is run. A missing parameter takes Default, or NULL unless it is Required.
+type ReportParam struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"` // text, integer, date or boolean
+	Required bool    `json:"required,omitempty"`
+	Default  *string `json:"default,omitempty"`
+}
+
+type reportInput struct {
+	Description    *string       `json:"description"`
+	Query          string        `json:"query"`
+	Params         []ReportParam `json:"params"`
+	MaxRows        int           `json:"maxRows"`
+	TimeoutSeconds int           `json:"timeoutSeconds"`
+}
+
+// validate checks in and fills in the defaults. The query itself is checked
+// by Postgres when the report is saved.
+func (in *reportInput) validate() error {
+	in.Query = strings.TrimSuffix(strings.TrimSpace(in.Query), ";")
+	if f := strings.Fields(in.Query); len(f) == 0 || (!strings.EqualFold(f[0], "select") && !strings.EqualFold(f[0], "with")) {
+		return errors.New("query must be a SELECT statement")
+	}
+	if in.Params == nil {
+		in.Params = []ReportParam{}
+	}
+	seen := map[string]bool{}
+	for i, p := range in.Params {
+		if !reportParamPattern.MatchString(p.Name) || p.Name == "org" || p.Name == "format" {
+			return fmt.Errorf("params[%d].name must be a lowercase identifier other than org and format", i)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("params[%d].name %q is repeated", i, p.Name)
+		}
+		seen[p.Name] = true
+		switch p.Type {
+		case "text", "integer", "date", "boolean":
+		default:
+			return fmt.Errorf("params[%d].type must be text, integer, date or boolean", i)
+		}
+		if p.Default != nil {
+			if _, err := reportParamValue(p, *p.Default); err != nil {
+				return fmt.Errorf("params[%d].default: %v", i, err)
+			}
+		}
+	}
+	switch {
+	case in.MaxRows == 0:
+		in.MaxRows = defaultReportRows
+	case in.MaxRows < 1 || in.MaxRows > maxReportRows:
+		return fmt.Errorf("maxRows must be between 1 and %d", maxReportRows)
+	}
+	switch {
+	case in.TimeoutSeconds == 0:
+		in.TimeoutSeconds = defaultReportTimeout
+	case in.TimeoutSeconds < 1 || in.TimeoutSeconds > maxReportTimeout:
+		return fmt.Errorf("timeoutSeconds must be between 1 and %d", maxReportTimeout)
+	}
+	return nil
+}
+
+// reportParamValue converts the value of parameter p given as v.
+func reportParamValue(p ReportParam, v string) (interface{}, error) {
+	switch p.Type {
+	case "integer":
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an integer", p.Name)
+		}
+		return n, nil
+	case "date":
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be YYYY-MM-DD", p.Name)
+		}
+		return t, nil
+	case "boolean":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be true or false", p.Name)
+		}
+		return b, nil
+	}
+	return v, nil
+}
+
+// bindReportQuery replaces the :name parameters of query with $n
+// placeholders, skipping string literals, quoted identifiers, comments and
+// :: casts, and wraps it in a subquery capped at limit rows. Postgres
+// accepts only a single query expression without data-modifying WITH
+// clauses inside a subquery. It returns the parameter names in placeholder
+// order.
+func bindReportQuery(query string, params []ReportParam, limit int) (string, []string, error) {
+	declared := map[string]bool{"org": true}
+	for _, p := range params {
+		declared[p.Name] = true
+	}
+	var (
+		b     strings.Builder
+		names []string
+		pos   = map[string]int{}
+	)
+	b.WriteString("SELECT * FROM (\n")
+	for i := 0; i < len(query); {
+		c, rest := query[i], query[i:]
+		var end int
+		switch {
+		case c == '\'' || c == '"':
+			end = skipPast(rest, 1, string(c))
+		case strings.HasPrefix(rest, "--"):
+			end = skipPast(rest, 2, "\n")
+		case strings.HasPrefix(rest, "/*"):
+			end = skipPast(rest, 2, "*/")
+		case strings.HasPrefix(rest, "::"):
+			end = 2
+		case c == ':' && len(rest) > 1 && (rest[1] == '_' || rest[1] >= 'a' && rest[1] <= 'z'):
+			end = 1
+			for end < len(rest) && (rest[end] == '_' || rest[end] >= 'a' && rest[end] <= 'z' || rest[end] >= '0' && rest[end] <= '9') {
+				end++
+			}
+			name := rest[1:end]
+			if !declared[name] {
+				return "", nil, fmt.Errorf("query uses undeclared parameter :%s", name)
+			}
+			n, ok := pos[name]
+			if !ok {
+				names = append(names, name)
+				n = len(names)
+				pos[name] = n
+			}
+			fmt.Fprintf(&b, "$%d", n)
+			i += end
+			continue
+		default:
+			end = 1
+		}
+		b.WriteString(rest[:end])
+		i += end
+	}
+	// a guard against forgetting the filter, not against a wrong one
+	if _, ok := pos["org"]; !ok {
+		return "", nil, errors.New("query must filter by :org, the organization of the caller")
+	}
+	fmt.Fprintf(&b, "\n) AS report LIMIT %d", limit)
+	return b.String(), names, nil
+}
+
+// skipPast returns the index just past the first sep in s at or after from,
+// or len(s) when there is none.
+func skipPast(s string, from int, sep string) int {
+	if i := strings.Index(s[from:], sep); i >= 0 {
+		return from + i + len(sep)
+	}
+	return len(s)
+}
+
+const reportColumns = `id, name, description, query, params, max_rows, timeout_seconds, created_at, updated_at`
+
+// reportsHandler handles GET (list) and POST (create) on /api/admin/reports.
+// Any admin may list and run reports; since a query can read the whole
+// database, only operators may write them.
+func reportsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && !isOperator(r.Context()) {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "reports are managed by the administrators of the first organization")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		listReports(w, r)
+	case http.MethodPost:
+		saveReport(w, r, "")
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// reportHandler handles GET (run), PUT and DELETE on
+// /api/admin/reports/{name}.
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && !isOperator(r.Context()) {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "reports are managed by the administrators of the first organization")
+		return
+	}
+	name := r.PathValue("name")
+	switch r.Method {
+	case http.MethodGet:
+		runReport(w, r, name)
+	case http.MethodPut:
+		saveReport(w, r, name)
+	case http.MethodDelete:
+		deleteReport(w, r, name)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+func listReports(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `SELECT `+reportColumns+` FROM reports ORDER BY name`)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list reports")
+		log.Printf("list reports error: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	items := []Report{}
+	for rows.Next() {
+		rep, err := scanReport(rows)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list reports")
+			log.Printf("scan report error: %v", err)
+			return
+		}
+		items = append(items, rep)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list reports")
+		log.Printf("list reports error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+}
+
+// saveReport creates a report (name == "", named in the body) or replaces
+// report name. Postgres prepares the query before it is stored, which
+// rejects syntax errors, unknown tables and columns, and anything but a
+// single SELECT.
+func saveReport(w http.ResponseWriter, r *http.Request, name string) {
+	var in struct {
+		Name string `json:"name"`
+		reportInput
+	}
+	warnings, err := decodeJSON(r.Body, &in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	create := name == ""
+	if create {
+		name = strings.TrimSpace(in.Name)
+	}
+	if !reportNamePattern.MatchString(name) {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "name must consist of lowercase letters, digits, - and _")
+		return
+	}
+	if err := in.validate(); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	bound, _, err := bindReportQuery(in.Query, in.Params, in.MaxRows+1)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	params, err := json.Marshal(in.Params)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to encode params")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var rep Report
+	status, event := http.StatusCreated, eventReportCreated
+	if !create {
+		status, event = http.StatusOK, eventReportUpdated
+	}
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, bound)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) {
+			return newStatusError(http.StatusBadRequest, codeBadRequest, "query is invalid: "+pqErr.Message)
+		}
+		if err != nil {
+			return fmt.Errorf("prepare report query: %w", err)
+		}
+		_ = stmt.Close()
+
+		if create {
+			rep, err = scanReport(tx.QueryRowContext(ctx, `
+INSERT INTO reports (name, description, query, params, max_rows, timeout_seconds) VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (name) DO NOTHING RETURNING `+reportColumns,
+				name, nullStringPtr(in.Description), in.Query, string(params), in.MaxRows, in.TimeoutSeconds))
+			if errors.Is(err, sql.ErrNoRows) {
+				return newStatusError(http.StatusConflict, codeConflict, "report already exists")
+			}
+		} else {
+			rep, err = scanReport(tx.QueryRowContext(ctx, `
+UPDATE reports SET description = $2, query = $3, params = $4, max_rows = $5, timeout_seconds = $6, updated_at = now()
+WHERE name = $1 RETURNING `+reportColumns,
+				name, nullStringPtr(in.Description), in.Query, string(params), in.MaxRows, in.TimeoutSeconds))
+			if errors.Is(err, sql.ErrNoRows) {
+				return newStatusError(http.StatusNotFound, codeNotFound, "report not found")
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("save report %s: %w", name, err)
+		}
+		return appendEvent(ctx, tx, event, rep.ID, map[string]interface{}{"id": rep.ID, "name": rep.Name})
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to save report")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"report": rep, "warnings": nonNilWarnings(warnings)})
+}
+
+func deleteReport(w http.ResponseWriter, r *http.Request, name string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	err := inTx(ctx, nil, func(tx *sql.Tx) error {
+		var id int64
+		err := tx.QueryRowContext(ctx, `DELETE FROM reports WHERE name = $1 RETURNING id`, name).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newStatusError(http.StatusNotFound, codeNotFound, "report not found")
+		}
+		if err != nil {
+			return fmt.Errorf("delete report %s: %w", name, err)
+		}
+		return appendEvent(ctx, tx, eventReportDeleted, id, map[string]interface{}{"id": id, "name": name})
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to delete report")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runReport runs report name for the caller's organization with the
+// parameters of the query string and writes the rows as JSON or, with
+// ?format=csv, as CSV. The query runs in a read-only transaction of the
+// caller's organization (see beginTx) under the report's statement
+// timeout; one row past the limit tells whether the result was cut.
+func runReport(w http.ResponseWriter, r *http.Request, name string) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "format must be json or csv")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	rep, err := scanReport(db.QueryRowContext(ctx, `SELECT `+reportColumns+` FROM reports WHERE name = $1`, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "report not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load report")
+		log.Printf("load report %s error: %v", name, err)
+		return
+	}
+	bound, names, err := bindReportQuery(rep.Query, rep.Params, rep.MaxRows+1)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "report definition is invalid")
+		log.Printf("bind report %s error: %v", name, err)
+		return
+	}
+	args, err := reportArgs(r.Context(), rep, names, q)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel = context.WithTimeout(r.Context(), time.Duration(rep.TimeoutSeconds+5)*time.Second)
+	defer cancel()
+
+	var (
+		columns   []string
+		result    [][]interface{}
+		truncated bool
+	)
+	err = inTx(ctx, reportTx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `SELECT set_config('statement_timeout', $1, true)`,
+			strconv.Itoa(rep.TimeoutSeconds*1000)); err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, bound, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		types, err := rows.ColumnTypes()
+		if err != nil {
+			return err
+		}
+		columns = make([]string, len(types))
+		for i, t := range types {
+			columns[i] = t.Name()
+		}
+		result, truncated = [][]interface{}{}, false
+		for rows.Next() {
+			if len(result) == rep.MaxRows {
+				truncated = true
+				break
+			}
+			values := make([]interface{}, len(types))
+			ptrs := make([]interface{}, len(types))
+			for i := range values {
+				ptrs[i] = &values[i]
+			}
+			if err := rows.Scan(ptrs...); err != nil {
+				return err
+			}
+			for i, v := range values {
+				switch v := v.(type) {
+				case []byte:
+					values[i] = string(v)
+				case time.Time:
+					if types[i].DatabaseTypeName() == "DATE" {
+						values[i] = v.Format("2006-01-02")
+					}
+				}
+			}
+			result = append(result, values)
+		}
+		return rows.Err()
+	})
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &pqErr) && pqErr.Code == "57014":
+		writeError(w, r, http.StatusBadRequest, codeBadRequest,
+			fmt.Sprintf("report exceeded its time limit of %d seconds", rep.TimeoutSeconds))
+		return
+	case errors.As(err, &pqErr) && (pqErr.Code.Class() == "22" || pqErr.Code.Class() == "42"):
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "report failed: "+pqErr.Message)
+		return
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to run report")
+		log.Printf("run report %s error: %v", name, err)
+		return
+	}
+
+	if format == "csv" {
+		writeReportCSV(w, rep.Name, columns, result, truncated)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"report": rep.Name, "columns": columns, "rows": result, "truncated": truncated,
+	})
+}
+
+// reportArgs returns the values of the placeholders of a report, in order.
+func reportArgs(ctx context.Context, rep Report, names []string, q map[string][]string) ([]interface{}, error) {
+	params := make(map[string]ReportParam, len(rep.Params))
+	for _, p := range rep.Params {
+		params[p.Name] = p
+	}
+	args := make([]interface{}, len(names))
+	for i, name := range names {
+		if name == "org" {
+			args[i] = orgFrom(ctx)
+			continue
+		}
+		p := params[name]
+		v, given := q[name]
+		switch {
+		case given && len(v) > 0:
+			val, err := reportParamValue(p, v[0])
+			if err != nil {
+				return nil, err
+			}
+			args[i] = val
+		case p.Default != nil:
+			args[i], _ = reportParamValue(p, *p.Default)
+		case p.Required:
+			return nil, fmt.Errorf("%s must be provided", name)
+		}
+	}
+	return args, nil
+}
+
+// writeReportCSV writes the rows of a report. A cut result is flagged in the
+// X-Report-Truncated header, since CSV has no room for it.
+func writeReportCSV(w http.ResponseWriter, name string, columns []string, rows [][]interface{}, truncated bool) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="report-%s-%s.csv"`, name, time.Now().UTC().Format("20060102-150405")))
+	if truncated {
+		w.Header().Set("X-Report-Truncated", "true")
+	}
+	cw := csv.NewWriter(w)
+	_ = cw.Write(columns)
+	for _, row := range rows {
+		rec := make([]string, len(row))
+		for i, v := range row {
+			switch v := v.(type) {
+			case nil:
+			case string:
+				rec[i] = v
+			case time.Time:
+				rec[i] = v.Format(time.RFC3339)
+			default:
+				rec[i] = fmt.Sprint(v)
+			}
+		}
+		_ = cw.Write(csvSafe(rec))
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("report %s export error: %v", name, err)
+	}
+}
+
+func scanReport(row rowScanner) (Report, error) {
+	var (
+		rep         Report
+		description sql.NullString
+		params      []byte
+	)
+	err := row.Scan(&rep.ID, &rep.Name, &description, &rep.Query, &params, &rep.MaxRows, &rep.TimeoutSeconds,
+		&rep.CreatedAt, &rep.UpdatedAt)
+	if err != nil {
+		return rep, err
+	}
+	rep.Description = stringPtr(description)
+	err = json.Unmarshal(params, &rep.Params)
+	return rep, err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBindReportQuery(t *testing.T) {
+	params := []ReportParam{{Name: "from", Type: "date"}, {Name: "child_id", Type: "integer"}}
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		names   []string
+		wantErr string
+	}{
+		{
+			name:  "parameters",
+			query: "SELECT id FROM checklists WHERE org_id = :org AND date_of_check >= :from AND child_id = :child_id",
+			want:  "SELECT id FROM checklists WHERE org_id = $1 AND date_of_check >= $2 AND child_id = $3",
+			names: []string{"org", "from", "child_id"},
+		},
+		{
+			name:  "repeated parameter",
+			query: "SELECT :from, :org, :from",
+			want:  "SELECT $1, $2, $1",
+			names: []string{"from", "org"},
+		},
+		{
+			name:  "casts",
+			query: "SELECT :from::date, x::text FROM t WHERE org_id = :org",
+			want:  "SELECT $1::date, x::text FROM t WHERE org_id = $2",
+			names: []string{"from", "org"},
+		},
+		{
+			name:  "string literal",
+			query: "SELECT ':from', 'it''s :child_id' WHERE org_id = :org",
+			want:  "SELECT ':from', 'it''s :child_id' WHERE org_id = $1",
+			names: []string{"org"},
+		},
+		{
+			name:  "quoted identifier",
+			query: `SELECT 1 AS ":from" WHERE org_id = :org`,
+			want:  `SELECT 1 AS ":from" WHERE org_id = $1`,
+			names: []string{"org"},
+		},
+		{
+			name:  "line comment",
+			query: "SELECT 1 -- :undeclared\nWHERE org_id = :org",
+			want:  "SELECT 1 -- :undeclared\nWHERE org_id = $1",
+			names: []string{"org"},
+		},
+		{
+			name:  "block comment",
+			query: "SELECT 1 /* :undeclared */ WHERE org_id = :org",
+			want:  "SELECT 1 /* :undeclared */ WHERE org_id = $1",
+			names: []string{"org"},
+		},
+		{
+			name:    "undeclared parameter",
+			query:   "SELECT :nope WHERE org_id = :org",
+			wantErr: "undeclared parameter :nope",
+		},
+		{
+			name:    "missing org",
+			query:   "SELECT id FROM checklists WHERE date_of_check >= :from",
+			wantErr: ":org",
+		},
+		{
+			name:    "org only in a comment",
+			query:   "SELECT id FROM checklists -- org_id = :org",
+			wantErr: ":org",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, names, err := bindReportQuery(tt.query, params, 10)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "SELECT * FROM (\n" + tt.want + "\n) AS report LIMIT 10"; got != want {
+				t.Errorf("query = %q, want %q", got, want)
+			}
+			if !reflect.DeepEqual(names, tt.names) {
+				t.Errorf("names = %v, want %v", names, tt.names)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	retentionPeriod = time.Hour
+
+	eventRetentionPurged  = "retention.purged"
+	eventRetentionUpdated = "retention.updated"
+)
+
+// retentionFields lists the free-text fields that may be purged after a
+// retention period, and the statement clearing them in one organization. A
+// checklist's age is counted from the examination date (or creation date
+// when it has none); structured answer values are never purged.
+var retentionFields = map[string]string{
+	"answers.comment": `UPDATE answers a SET comment = NULL FROM checklists c
+WHERE a.checklist_id = c.id AND a.comment IS NOT NULL AND c.org_id = $2
+  AND COALESCE(c.date_of_check, c.created_at::date) < current_date - make_interval(months => $1)`,
+	"checklists.child_name": `UPDATE checklists SET child_name = NULL
+WHERE child_name IS NOT NULL AND org_id = $2
+  AND COALESCE(date_of_check, created_at::date) < current_date - make_interval(months => $1)`,
+	"checklists.specialist": `UPDATE checklists SET specialist = NULL
+WHERE specialist IS NOT NULL AND org_id = $2
+  AND COALESCE(date_of_check, created_at::date) < current_date - make_interval(months => $1)`,
+}
+
+// retentionDraftFields clear the same fields in the drafts of one
+// organization, whose age is counted from their last change.
+var retentionDraftFields = map[string]string{
+	"answers.comment": `UPDATE checklist_drafts SET data = jsonb_set(data, '{answers}',
+  (SELECT jsonb_agg(a - 'comment' ORDER BY n) FROM jsonb_array_elements(data->'answers') WITH ORDINALITY AS e(a, n)))
+WHERE org_id = $2 AND updated_at < now() - make_interval(months => $1)
+  AND jsonb_typeof(data->'answers') = 'array'
+  AND EXISTS (SELECT 1 FROM jsonb_array_elements(data->'answers') a WHERE a ? 'comment')`,
+	"checklists.child_name": `UPDATE checklist_drafts SET data = data - 'childName'
+WHERE org_id = $2 AND data ? 'childName' AND updated_at < now() - make_interval(months => $1)`,
+	"checklists.specialist": `UPDATE checklist_drafts SET data = data - 'specialist'
+WHERE org_id = $2 AND data ? 'specialist' AND updated_at < now() - make_interval(months => $1)`,
+}
+
+// fieldRule purges a field of checklists older than the given number of months.
+type fieldRule struct {
+	Field  string `json:"field"`
+	Months int    `json:"months"`
+}
+
+// defaultRetentionRules (RETENTION_RULES) apply to the organizations that
+// have not set rules of their own.
+var defaultRetentionRules []fieldRule
+
+// validateRetentionRules checks that every rule names a field that supports
+// retention, once, with a positive number of months.
+func validateRetentionRules(rules []fieldRule) error {
+	seen := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if _, ok := retentionFields[rule.Field]; !ok {
+			return fmt.Errorf("field %q does not support retention", rule.Field)
+		}
+		if seen[rule.Field] {
+			return fmt.Errorf("field %q is listed twice", rule.Field)
+		}
+		seen[rule.Field] = true
+		if rule.Months < 1 {
+			return fmt.Errorf("months for %q must be a positive integer", rule.Field)
+		}
+	}
+	return nil
+}
+
+// parseRetentionRules parses RETENTION_RULES, e.g. "answers.comment=24,checklists.child_name=60".
+func parseRetentionRules(v string) ([]fieldRule, error) {
+	var rules []fieldRule
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		field, months, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("rule %q must be field=months", part)
+		}
+		field = strings.TrimSpace(field)
+		n, err := strconv.Atoi(strings.TrimSpace(months))
+		if err != nil {
+			return nil, fmt.Errorf("months for %q must be a positive integer", field)
+		}
+		rules = append(rules, fieldRule{Field: field, Months: n})
+	}
+	return rules, validateRetentionRules(rules)
+}
+
+// startRetention runs the retention rules once an hour:
+//   - EVENTS_RETENTION_DAYS deletes events older than the given number of days;
+//   - the rules of every organization, or RETENTION_RULES for those without
+//     their own, clear free-text fields of old checklists.
+//
+// Without rules and EVENTS_RETENTION_DAYS nothing is ever removed.
+func startRetention() {
+	eventDays := 0
+	if v := os.Getenv("EVENTS_RETENTION_DAYS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("EVENTS_RETENTION_DAYS must be a positive integer, got %q", v)
+		}
+		eventDays = n
+	}
+	rules, err := parseRetentionRules(os.Getenv("RETENTION_RULES"))
+	if err != nil {
+		log.Fatalf("invalid RETENTION_RULES: %v", err)
+	}
+	defaultRetentionRules = rules
+
+	go func() {
+		for {
+			applyRetentionRules()
+			if eventDays > 0 {
+				purgeEvents(eventDays)
+			}
+			time.Sleep(retentionPeriod)
+		}
+	}()
+}
+
+// applyRetentionRules applies the rules of every organization.
+func applyRetentionRules() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `SELECT id, retention_rules FROM organizations ORDER BY id`)
+	if err != nil {
+		log.Printf("retention error: %v", err)
+		return
+	}
+	rulesByOrg := map[int64][]fieldRule{}
+	var orgs []int64
+	for rows.Next() {
+		var (
+			org  int64
+			data []byte
+		)
+		if err := rows.Scan(&org, &data); err != nil {
+			rows.Close()
+			log.Printf("retention error: %v", err)
+			return
+		}
+		rules := defaultRetentionRules
+		if data != nil {
+			if err := json.Unmarshal(data, &rules); err != nil {
+				log.Printf("retention rules of organization %d error: %v", org, err)
+				continue
+			}
+		}
+		orgs = append(orgs, org)
+		rulesByOrg[org] = rules
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("retention error: %v", err)
+		return
+	}
+
+	for _, org := range orgs {
+		for _, rule := range rulesByOrg[org] {
+			if err := applyFieldRule(org, rule); err != nil {
+				log.Printf("retention of %s in organization %d error: %v", rule.Field, org, err)
+			}
+		}
+	}
+}
+
+// applyFieldRule clears the field in the checklists and drafts of org and
+// records how many rows were purged in the event log of org, in one
+// transaction. Responses kept for Idempotency-Key replays of the purged
+// checklists are dropped with it.
+func applyFieldRule(org int64, rule fieldRule) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	ctx = withOrg(ctx, org)
+
+	var n int64
+	err := inTx(ctx, nil, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, retentionFields[rule.Field], rule.Months, org)
+		if err != nil {
+			return err
+		}
+		n, _ = res.RowsAffected()
+		if n > 0 {
+			// purged text must not stay findable through the search index
+			// nor in a stored response
+			if _, err := tx.ExecContext(ctx, `UPDATE checklists c SET search_vector = `+checklistSearchVector+`
+WHERE c.org_id = $2 AND COALESCE(c.date_of_check, c.created_at::date) < current_date - make_interval(months => $1)`,
+				rule.Months, org); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `DELETE FROM idempotency_keys k USING checklists c
+WHERE k.checklist_id = c.id AND c.org_id = $2
+  AND COALESCE(c.date_of_check, c.created_at::date) < current_date - make_interval(months => $1)`,
+				rule.Months, org); err != nil {
+				return err
+			}
+		}
+
+		res, err = tx.ExecContext(ctx, retentionDraftFields[rule.Field], rule.Months, org)
+		if err != nil {
+			return err
+		}
+		drafts, _ := res.RowsAffected()
+		if n += drafts; n == 0 {
+			return nil
+		}
+
+		payload := map[string]interface{}{"field": rule.Field, "months": rule.Months, "rows": n}
+		return appendEvent(ctx, tx, eventRetentionPurged, 0, payload)
+	})
+	if err != nil || n == 0 {
+		return err
+	}
+	log.Printf("retention: cleared %s in %d rows of organization %d older than %d months", rule.Field, n, org, rule.Months)
+	return nil
+}
+
+// retentionHandler handles GET, PUT and DELETE on /api/admin/retention: the
+// retention rules of the organization. PUT replaces them (an empty list
+// keeps everything), DELETE goes back to RETENTION_RULES.
+func retentionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getRetentionRules(w, r)
+	case http.MethodPut:
+		putRetentionRules(w, r)
+	case http.MethodDelete:
+		deleteRetentionRules(w, r)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// RetentionRules are the rules in force in an organization; Inherited is set
+// when they are RETENTION_RULES.
+type RetentionRules struct {
+	Rules     []fieldRule `json:"rules"`
+	Inherited bool        `json:"inherited"`
+}
+
+func getRetentionRules(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var data []byte
+	err := db.QueryRowContext(ctx, `SELECT retention_rules FROM organizations WHERE id = $1`, orgFrom(ctx)).Scan(&data)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load retention rules")
+		log.Printf("load retention rules error: %v", err)
+		return
+	}
+	rr := RetentionRules{Rules: defaultRetentionRules, Inherited: data == nil}
+	if data != nil {
+		if err := json.Unmarshal(data, &rr.Rules); err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load retention rules")
+			log.Printf("load retention rules error: %v", err)
+			return
+		}
+	}
+	if rr.Rules == nil {
+		rr.Rules = []fieldRule{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rr)
+}
+
+func putRetentionRules(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Rules []fieldRule `json:"rules"`
+	}
+	warnings, err := decodeJSON(r.Body, &in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	if in.Rules == nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "rules must be provided")
+		return
+	}
+	if err := validateRetentionRules(in.Rules); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	data, err := json.Marshal(in.Rules)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to save retention rules")
+		log.Printf("encode retention rules error: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	if err := setRetentionRules(ctx, string(data), in.Rules); err != nil {
+		writeStatusError(w, r, err, "failed to save retention rules")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := struct {
+		RetentionRules
+		Warnings []string `json:"warnings"`
+	}{RetentionRules{Rules: in.Rules}, nonNilWarnings(warnings)}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func deleteRetentionRules(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	if err := setRetentionRules(ctx, nil, nil); err != nil {
+		writeStatusError(w, r, err, "failed to reset retention rules")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setRetentionRules stores the rules of the organization of ctx, NULL to
+// inherit RETENTION_RULES, and records the change in the event log.
+func setRetentionRules(ctx context.Context, data interface{}, rules []fieldRule) error {
+	return inTx(ctx, nil, func(tx *sql.Tx) error {
+		org := orgFrom(ctx)
+		if _, err := tx.ExecContext(ctx, `UPDATE organizations SET retention_rules = $2 WHERE id = $1`, org, data); err != nil {
+			return err
+		}
+		return appendEvent(ctx, tx, eventRetentionUpdated, org, map[string]interface{}{"rules": rules, "inherited": data == nil})
+	})
+}
+
+func purgeEvents(days int) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var n int64
+	err := inTx(ctx, nil, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx,
+			`DELETE FROM events WHERE created_at < now() - make_interval(days => $1)`, days)
+		if err != nil {
+			return err
+		}
+		n, _ = res.RowsAffected()
+		return nil
+	})
+	if err != nil {
+		log.Printf("event retention error: %v", err)
+	} else if n > 0 {
+		log.Printf("event retention: deleted %d events older than %d days", n, days)
+	}
+}
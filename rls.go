@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// rlsEnabled (DB_RLS) turns on Postgres row-level security: every
+// transaction tells Postgres who is acting and for which organization, and
+// the policies below hide the rows of other organizations and refuse writes
+// to checklists of other specialists even if a handler forgets its check.
+// Every query on these tables must therefore run in inTx, reads with
+// snapshotTx.
+var rlsEnabled bool
+
+// rlsTables are the tables whose rows belong to an organization through
+// their org_id column. Answers belong to the organization of their checklist
+// and events without an organization are visible to all.
+var rlsTables = []string{"checklists", "answers", "children", "specialists", "checklist_drafts",
+	"intervention_groups", "import_jobs", "events"}
+
+// rlsSchema is created whether or not the mode is on; applyRLS only enables
+// or disables the policies. app.role is "system" for background jobs and
+// when authentication is off.
+const rlsSchema = `
+DROP POLICY IF EXISTS checklists_read ON checklists;
+DROP POLICY IF EXISTS checklists_write ON checklists;
+DROP POLICY IF EXISTS answers_read ON answers;
+DROP POLICY IF EXISTS answers_write ON answers;
+DROP POLICY IF EXISTS children_org ON children;
+DROP POLICY IF EXISTS specialists_org ON specialists;
+DROP POLICY IF EXISTS checklist_drafts_org ON checklist_drafts;
+DROP POLICY IF EXISTS intervention_groups_org ON intervention_groups;
+DROP POLICY IF EXISTS import_jobs_org ON import_jobs;
+DROP POLICY IF EXISTS events_org ON events;
+DROP FUNCTION IF EXISTS app_may_write(BIGINT);
+
+CREATE OR REPLACE FUNCTION app_may_read(org BIGINT) RETURNS BOOLEAN
+LANGUAGE sql STABLE AS $$
+  SELECT current_setting('app.role', true) = 'system'
+      OR org = NULLIF(current_setting('app.org_id', true), '')::BIGINT
+$$;
+
+CREATE OR REPLACE FUNCTION app_may_write(owner BIGINT, org BIGINT) RETURNS BOOLEAN
+LANGUAGE sql STABLE AS $$
+  SELECT current_setting('app.role', true) = 'system'
+      OR (org = NULLIF(current_setting('app.org_id', true), '')::BIGINT
+          AND (current_setting('app.role', true) = 'admin'
+               OR (current_setting('app.role', true) = 'specialist'
+                   AND owner = NULLIF(current_setting('app.specialist_id', true), '')::BIGINT)))
+$$;
+
+CREATE POLICY checklists_read ON checklists FOR SELECT USING (app_may_read(org_id));
+CREATE POLICY checklists_write ON checklists FOR ALL
+  USING (app_may_write(specialist_id, org_id)) WITH CHECK (app_may_write(specialist_id, org_id));
+
+CREATE POLICY answers_read ON answers FOR SELECT
+  USING (app_may_read((SELECT c.org_id FROM checklists c WHERE c.id = checklist_id)));
+CREATE POLICY answers_write ON answers FOR ALL
+  USING (app_may_write((SELECT c.specialist_id FROM checklists c WHERE c.id = checklist_id),
+                       (SELECT c.org_id FROM checklists c WHERE c.id = checklist_id)))
+  WITH CHECK (app_may_write((SELECT c.specialist_id FROM checklists c WHERE c.id = checklist_id),
+                            (SELECT c.org_id FROM checklists c WHERE c.id = checklist_id)));
+
+CREATE POLICY children_org ON children FOR ALL USING (app_may_read(org_id)) WITH CHECK (app_may_read(org_id));
+CREATE POLICY specialists_org ON specialists FOR ALL USING (app_may_read(org_id)) WITH CHECK (app_may_read(org_id));
+CREATE POLICY checklist_drafts_org ON checklist_drafts FOR ALL USING (app_may_read(org_id)) WITH CHECK (app_may_read(org_id));
+CREATE POLICY intervention_groups_org ON intervention_groups FOR ALL
+  USING (app_may_read(org_id)) WITH CHECK (app_may_read(org_id));
+CREATE POLICY import_jobs_org ON import_jobs FOR ALL USING (app_may_read(org_id)) WITH CHECK (app_may_read(org_id));
+CREATE POLICY events_org ON events FOR ALL
+  USING (org_id IS NULL OR app_may_read(org_id)) WITH CHECK (org_id IS NULL OR app_may_read(org_id));
+`
+
+// configureRLS reads DB_RLS.
+func configureRLS() {
+	v := os.Getenv("DB_RLS")
+	if v == "" {
+		return
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("DB_RLS must be a boolean, got %q", v)
+	}
+	rlsEnabled = on
+}
+
+// applyRLS creates the policies and enables them when the mode is on. FORCE
+// is needed because the server usually connects as the owner of the tables,
+// to whom policies do not apply otherwise.
+func applyRLS(db *sql.DB) error {
+	if _, err := db.Exec(rlsSchema); err != nil {
+		return err
+	}
+	var stmt strings.Builder
+	for _, t := range rlsTables {
+		if rlsEnabled {
+			fmt.Fprintf(&stmt, "ALTER TABLE %s ENABLE ROW LEVEL SECURITY;\nALTER TABLE %[1]s FORCE ROW LEVEL SECURITY;\n", t)
+		} else {
+			fmt.Fprintf(&stmt, "ALTER TABLE %s NO FORCE ROW LEVEL SECURITY;\nALTER TABLE %[1]s DISABLE ROW LEVEL SECURITY;\n", t)
+		}
+	}
+	if _, err := db.Exec(stmt.String()); err != nil {
+		return err
+	}
+	if !rlsEnabled {
+		return nil
+	}
+	var bypass bool
+	if err := db.QueryRow(`SELECT rolsuper OR rolbypassrls FROM pg_roles WHERE rolname = current_user`).Scan(&bypass); err != nil {
+		return err
+	}
+	if bypass {
+		log.Printf("DB_RLS is on but the database user bypasses row-level security (superuser or BYPASSRLS): policies are not enforced")
+	} else {
+		log.Printf("row-level security enabled for %s", strings.Join(rlsTables, ", "))
+	}
+	return nil
+}
+
+// beginTx starts a transaction for inTx. In DB_RLS mode it first sets, for
+// this transaction only, the role, specialist id and organization the
+// policies check.
+func beginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil || !rlsEnabled {
+		return tx, err
+	}
+	role, specialistID := "system", ""
+	if c := authFrom(ctx); c != nil {
+		role, specialistID = c.Role, strconv.FormatInt(c.SpecialistID(), 10)
+	}
+	// set_config(..., true) is SET LOCAL with bind parameters
+	if _, err := tx.ExecContext(ctx, `SELECT set_config('app.role', $1, true), set_config('app.specialist_id', $2, true),
+       set_config('app.org_id', $3, true)`,
+		role, specialistID, strconv.FormatInt(orgFrom(ctx), 10)); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// actForOrg makes the policies check org instead of the organization of ctx
+// for the rest of tx, for an operator writing the rows of another
+// organization. It does nothing outside DB_RLS mode.
+func actForOrg(ctx context.Context, tx *sql.Tx, org int64) error {
+	if !rlsEnabled {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `SELECT set_config('app.org_id', $1, true)`, strconv.FormatInt(org, 10))
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Roles of an account. Each role includes the permissions of the ones
+// before it: viewers read, specialists also file and correct their own
+// checklists and maintain children and groups, admins manage specialists,
+// announcements, imports and everyone's checklists.
+const (
+	roleViewer     = "viewer"
+	roleSpecialist = "specialist"
+	roleAdmin      = "admin"
+)
+
+var roleRank = map[string]int{roleViewer: 1, roleSpecialist: 2, roleAdmin: 3}
+
+// errNotOwner is returned when a specialist touches someone else's checklist.
+var errNotOwner = errors.New("specialists can only edit their own checklists")
+
+func validRole(role string) bool {
+	return roleRank[role] > 0
+}
+
+// hasRole reports whether the claims grant at least role.
+func (c authClaims) hasRole(role string) bool {
+	return roleRank[c.Role] >= roleRank[role]
+}
+
+// requiredRole is the role needed for the request: reads need any role,
+// writes need a specialist, and the administration routes an admin.
+// Changing a password is checked by the handler, since anyone may change
+// their own.
+func requiredRole(r *http.Request) string {
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/api/admin/") || strings.HasPrefix(path, "/api/audit/") {
+		return roleAdmin
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return roleViewer
+	}
+	switch {
+	case strings.HasPrefix(path, "/api/specialists/") && strings.HasSuffix(path, "/password"):
+		return roleViewer
+	case path == "/api/specialists" || strings.HasPrefix(path, "/api/specialists/"):
+		return roleAdmin
+	case path == "/api/checklist/import":
+		// imports file checklists under any specialist
+		return roleAdmin
+	}
+	return roleSpecialist
+}
+
+// isAdmin reports whether the request may act on behalf of anyone: it is made
+// by an admin or authentication is off.
+func isAdmin(ctx context.Context) bool {
+	c := authFrom(ctx)
+	return c == nil || c.hasRole(roleAdmin)
+}
+
+// ownChecklist files c under the authenticated specialist when it names no
+// specialist and refuses it when it names another one. Admins may file
+// checklists under anyone.
+func ownChecklist(ctx context.Context, c *Checklist) error {
+	if isAdmin(ctx) {
+		return nil
+	}
+	self := authFrom(ctx).SpecialistID()
+	if c.SpecialistID == nil {
+		c.SpecialistID = &self
+		return nil
+	}
+	if *c.SpecialistID != self {
+		return errNotOwner
+	}
+	return nil
+}
+
+// canEditChecklist reports whether the request may change a stored checklist
+// filed under specialistID (NULL for checklists not linked to a specialist,
+// which only admins may change).
+func canEditChecklist(ctx context.Context, specialistID *int64) bool {
+	if isAdmin(ctx) {
+		return true
+	}
+	return specialistID != nil && *specialistID == authFrom(ctx).SpecialistID()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maxAnswerPredicates bounds the number of conditions in one search.
+const maxAnswerPredicates = 20
+
+// searchResultLimit caps the number of children returned by a search.
+const searchResultLimit = 500
+
+// answerPredicate matches checklists that have an answer with the given key and value.
+type answerPredicate struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ChildMatch is a child found by an answer search, with the latest of the
+// checklists whose answers matched.
+type ChildMatch struct {
+	ChildID   *int64           `json:"childId"`
+	ChildName *string          `json:"childName"`
+	Checklist ChecklistSummary `json:"latestChecklist"`
+}
+
+// checklistSearchHandler handles GET /api/checklist/search?key=k1&value=v1&key=k2&value=v2
+// and returns the children whose latest answers match every key/value pair.
+func checklistSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	preds, err := parseAnswerPredicates(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var items []ChildMatch
+	err = inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		var err error
+		items, err = findChildrenByAnswers(ctx, tx, preds, searchResultLimit+1)
+		return err
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to search checklists")
+		log.Printf("search checklists error: %v", err)
+		return
+	}
+	truncated := len(items) > searchResultLimit
+	if truncated {
+		items = items[:searchResultLimit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"criteria": preds, "items": items, "truncated": truncated}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// parseAnswerPredicates pairs repeated key and value query parameters in order.
+func parseAnswerPredicates(q url.Values) ([]answerPredicate, error) {
+	keys, values := q["key"], q["value"]
+	if len(keys) != len(values) {
+		return nil, fmt.Errorf("each key must have a matching value")
+	}
+
+	preds := make([]answerPredicate, 0, len(keys))
+	for i := range keys {
+		preds = append(preds, answerPredicate{Key: keys[i], Value: values[i]})
+	}
+	return preds, validateAnswerPredicates(preds)
+}
+
+// validateAnswerPredicates trims predicates in place and checks their count.
+func validateAnswerPredicates(preds []answerPredicate) error {
+	if len(preds) == 0 {
+		return fmt.Errorf("at least one key/value pair is required")
+	}
+	if len(preds) > maxAnswerPredicates {
+		return fmt.Errorf("at most %d key/value pairs are allowed", maxAnswerPredicates)
+	}
+	for i := range preds {
+		preds[i].Key, preds[i].Value = strings.TrimSpace(preds[i].Key), strings.TrimSpace(preds[i].Value)
+		if preds[i].Key == "" || preds[i].Value == "" {
+			return fmt.Errorf("key and value must not be empty")
+		}
+	}
+	return nil
+}
+
+// childKey identifies the child of checklist c: the registry id, else the
+// name ignoring case and surrounding spaces.
+const childKey = `CASE WHEN c.child_id IS NOT NULL THEN 'id:' || c.child_id ELSE 'name:' || lower(btrim(c.child_name)) END`
+
+// findChildrenByAnswers returns the children of the organization of ctx for
+// whom every predicate holds, evaluated per child: for every key the latest
+// given answer of the child's checklists counts, so the answers may come from
+// different assessments while answers that were superseded do not match.
+// Each child comes with the latest checklist that supplied one of these
+// answers; children are ordered by its examination date, newest first. A
+// limit of 0 returns all of them.
+func findChildrenByAnswers(ctx context.Context, q queryer, preds []answerPredicate, limit int) ([]ChildMatch, error) {
+	keys := make([]string, 0, len(preds))
+	for _, p := range preds {
+		keys = append(keys, p.Key)
+	}
+	var (
+		conds []string
+		args  = []interface{}{orgFrom(ctx), pq.Array(keys)}
+	)
+	for _, p := range preds {
+		args = append(args, p.Key, p.Value)
+		conds = append(conds, fmt.Sprintf(`bool_or(key_name = $%d AND value = $%d)`, len(args)-1, len(args)))
+	}
+
+	query := `
+WITH latest AS (
+  SELECT DISTINCT ON (child_key, a.key_name) ` + childKey + ` AS child_key, a.key_name, a.value,
+         c.id AS checklist_id, c.date_of_check
+  FROM checklists c JOIN answers a ON a.checklist_id = c.id
+  WHERE c.org_id = $1 AND c.archived_at IS NULL AND (c.child_id IS NOT NULL OR c.child_name IS NOT NULL)
+    AND a.key_name = ANY($2) AND a.value IS NOT NULL
+  ORDER BY child_key, a.key_name, c.date_of_check DESC NULLS LAST, c.id DESC
+), matched AS (
+  SELECT (array_agg(checklist_id ORDER BY date_of_check DESC NULLS LAST, checklist_id DESC))[1] AS checklist_id
+  FROM latest GROUP BY child_key
+  HAVING ` + strings.Join(conds, " AND ") + `
+)
+SELECT ` + checklistSummaryColumns + ` FROM checklists c JOIN matched m ON m.checklist_id = c.id
+ORDER BY c.date_of_check DESC NULLS LAST, c.id DESC`
+	if limit > 0 {
+		query += fmt.Sprintf(` LIMIT %d`, limit)
+	}
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries, err := scanChecklistSummaries(rows)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]ChildMatch, 0, len(summaries))
+	for _, s := range summaries {
+		items = append(items, ChildMatch{ChildID: s.ChildID, ChildName: s.ChildName, Checklist: s})
+	}
+	return items, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// secretEnv returns the secret configured by the environment variable name
+// or, for Docker and Kubernetes secrets, read from the file named by
+// name_FILE. Setting both is a configuration error.
+func secretEnv(name string) string {
+	s, err := readSecretEnv(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return s
+}
+
+// readSecretEnv is secretEnv for secrets re-read at runtime, where a bad
+// value must not stop the server.
+func readSecretEnv(name string) (string, error) {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return os.Getenv(name), nil
+	}
+	if os.Getenv(name) != "" {
+		return "", fmt.Errorf("%s and %s_FILE are both set; use one of them", name, name)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s_FILE: %w", name, err)
+	}
+	// secret files usually end with a newline
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
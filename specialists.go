@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Specialist is a person filling in checklists.
+type Specialist struct {
+	ID            int64      `json:"id"`
+	Name          string     `json:"name"`
+	Position      *string    `json:"position"`
+	Email         *string    `json:"email"`
+	Login         *string    `json:"login"` // set with PUT /api/specialists/{id}/password
+	Role          string     `json:"role"`
+	Active        bool       `json:"active"`
+	DeactivatedAt *time.Time `json:"deactivatedAt"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     *time.Time `json:"updatedAt"`
+}
+
+type specialistInput struct {
+	Name     string  `json:"name"`
+	Position *string `json:"position"`
+	Email    *string `json:"email"`
+	Role     string  `json:"role"`   // admin, specialist or viewer; omitted keeps the current role (specialist for new ones)
+	Active   *bool   `json:"active"` // PUT only; omitted keeps the current state
+}
+
+// SpecialistWorkload is one row of GET /api/specialists/workload.
+type SpecialistWorkload struct {
+	SpecialistID  int64   `json:"specialistId"`
+	Name          string  `json:"name"`
+	Active        bool    `json:"active"`
+	Checklists    int     `json:"checklists"`
+	Children      int     `json:"children"`
+	LastCheckDate *string `json:"lastCheckDate"`
+}
+
+// specialistColumns selects a Specialist from specialists aliased as s.
+const specialistColumns = `s.id, s.name, s.position, s.email, s.login, s.role, s.deactivated_at, s.created_at, s.updated_at`
+
+var (
+	// errUnknownSpecialist and errSpecialistInactive are returned by
+	// linkSpecialist; the transaction stays usable.
+	errUnknownSpecialist  = errors.New("unknown specialistId")
+	errSpecialistInactive = errors.New("specialist is deactivated")
+
+	errEmailExists = errors.New("email already exists")
+)
+
+// specialistsHandler handles GET (list) and POST (create) on /api/specialists
+func specialistsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listSpecialists(w, r)
+	case http.MethodPost:
+		createSpecialist(w, r)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// listSpecialists returns specialists ordered by name, optionally filtered
+// with ?q= (part of the name) and ?active=true|false.
+func listSpecialists(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var (
+		conds = []string{"s.org_id = $1"}
+		args  = []interface{}{orgFrom(r.Context())}
+	)
+	if v := strings.TrimSpace(q.Get("q")); v != "" {
+		args = append(args, v)
+		conds = append(conds, fmt.Sprintf(`s.name ILIKE '%%' || $%d || '%%'`, len(args)))
+	}
+	if v := q.Get("active"); v != "" {
+		active, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "active must be true or false")
+			return
+		}
+		if active {
+			conds = append(conds, "s.deactivated_at IS NULL")
+		} else {
+			conds = append(conds, "s.deactivated_at IS NOT NULL")
+		}
+	}
+	where := "\nWHERE " + strings.Join(conds, " AND ")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var items []Specialist
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT `+specialistColumns+` FROM specialists s`+where+`
+ORDER BY lower(s.name), s.id`, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		items = []Specialist{}
+		for rows.Next() {
+			s, err := scanSpecialist(rows)
+			if err != nil {
+				return err
+			}
+			items = append(items, s)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list specialists")
+		log.Printf("list specialists error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+}
+
+func createSpecialist(w http.ResponseWriter, r *http.Request) {
+	var in specialistInput
+	warnings, err := decodeJSON(r.Body, &in)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	if err := validateSpecialistInput(&in); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var (
+		id int64
+		s  Specialist
+	)
+	err = inTx(ctx, nil, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx,
+			`INSERT INTO specialists (name, position, email, role, org_id) VALUES ($1, $2, $3, COALESCE($4, 'specialist'), $5)
+             ON CONFLICT (org_id, email) DO NOTHING
+             RETURNING id`,
+			in.Name, nullStringPtr(in.Position), nullStringPtr(in.Email), nullStringPtr(&in.Role), orgFrom(ctx)).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newStatusError(http.StatusConflict, codeConflict, errEmailExists.Error())
+		}
+		if err != nil {
+			return fmt.Errorf("insert specialist: %w", err)
+		}
+		if s, err = loadSpecialist(ctx, tx, id); err != nil {
+			return fmt.Errorf("load specialist %d: %w", id, err)
+		}
+		return appendEvent(ctx, tx, eventSpecialistCreated, id, map[string]interface{}{"id": id})
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to insert specialist")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/api/specialists/%d", id))
+	w.WriteHeader(http.StatusCreated)
+	resp := map[string]interface{}{"specialist": s, "warnings": nonNilWarnings(warnings)}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// specialistHandler handles GET, PUT (replace) and DELETE (deactivate) on
+// /api/specialists/{id}. Specialists are never removed: their checklists
+// keep referring to them.
+func specialistHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid specialist id")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		var s Specialist
+		err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+			var err error
+			s, err = loadSpecialist(ctx, tx, id)
+			return err
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "specialist not found")
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load specialist")
+			log.Printf("load specialist %d error: %v", id, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s)
+	case http.MethodPut:
+		var in specialistInput
+		warnings, err := decodeJSON(r.Body, &in)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("invalid json: %v", err))
+			return
+		}
+		if err := validateSpecialistInput(&in); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
+		updateSpecialist(ctx, w, r, id, in, warnings)
+	case http.MethodDelete:
+		inactive := false
+		updateSpecialist(ctx, w, r, id, specialistInput{Active: &inactive}, nil)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// updateSpecialist applies in to specialist id. An empty in.Name changes
+// only the active state, which is how DELETE deactivates.
+func updateSpecialist(ctx context.Context, w http.ResponseWriter, r *http.Request, id int64, in specialistInput, warnings []string) {
+	var s Specialist
+	err := inTx(ctx, nil, func(tx *sql.Tx) error {
+		var deactivatedAt sql.NullTime
+		err := tx.QueryRowContext(ctx, `SELECT deactivated_at FROM specialists WHERE id = $1 AND org_id = $2 FOR UPDATE`,
+			id, orgFrom(ctx)).Scan(&deactivatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newStatusError(http.StatusNotFound, codeNotFound, "specialist not found")
+		}
+		if err != nil {
+			return fmt.Errorf("lock specialist %d: %w", id, err)
+		}
+
+		if in.Name != "" {
+			_, err = tx.ExecContext(ctx,
+				`UPDATE specialists SET name = $2, position = $3, email = $4, role = COALESCE($5, role), updated_at = now()
+                 WHERE id = $1`,
+				id, in.Name, nullStringPtr(in.Position), nullStringPtr(in.Email), nullStringPtr(&in.Role))
+			if isUniqueViolation(err) {
+				return newStatusError(http.StatusConflict, codeConflict, errEmailExists.Error())
+			}
+			if err != nil {
+				return fmt.Errorf("update specialist %d: %w", id, err)
+			}
+		}
+		event := eventSpecialistUpdated
+		if in.Active != nil && *in.Active == deactivatedAt.Valid {
+			if *in.Active {
+				_, err = tx.ExecContext(ctx, `UPDATE specialists SET deactivated_at = NULL, updated_at = now() WHERE id = $1`, id)
+			} else {
+				_, err = tx.ExecContext(ctx, `UPDATE specialists SET deactivated_at = now(), updated_at = now() WHERE id = $1`, id)
+				event = eventSpecialistDeactivated
+			}
+			if err != nil {
+				return fmt.Errorf("update specialist %d: %w", id, err)
+			}
+		}
+
+		if s, err = loadSpecialist(ctx, tx, id); err != nil {
+			return fmt.Errorf("load specialist %d: %w", id, err)
+		}
+		return appendEvent(ctx, tx, event, id, map[string]interface{}{"id": id, "active": s.Active, "role": s.Role})
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to update specialist")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"specialist": s, "warnings": nonNilWarnings(warnings)}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// specialistWorkloadHandler handles GET /api/specialists/workload: the number
+// of checklists and distinct children per specialist, optionally limited to
+// examinations within ?from=&to= (YYYY-MM-DD, inclusive). Only checklists
+// linked by specialistId are counted; the number of others is returned as
+// "unlinked".
+func specialistWorkloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	conds := []string{"c.org_id = $1", "c.archived_at IS NULL"}
+	args := []interface{}{orgFrom(r.Context())}
+	for _, p := range []struct{ name, cond string }{{"from", ">="}, {"to", "<="}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, p.name+" must be YYYY-MM-DD")
+			return
+		}
+		args = append(args, t)
+		conds = append(conds, fmt.Sprintf("c.date_of_check %s $%d", p.cond, len(args)))
+	}
+	filter := strings.Join(conds, " AND ")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	// both queries read one snapshot, so unlinked adds up with the items
+	var (
+		items    []SpecialistWorkload
+		unlinked int
+	)
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `
+SELECT s.id, s.name, s.deactivated_at IS NULL, count(c.id),
+       count(DISTINCT COALESCE(c.child_id::text, lower(c.child_name))), max(c.date_of_check)
+FROM specialists s
+LEFT JOIN checklists c ON c.specialist_id = s.id AND `+filter+`
+WHERE s.org_id = $1
+GROUP BY s.id
+ORDER BY count(c.id) DESC, lower(s.name), s.id`, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		items = []SpecialistWorkload{}
+		for rows.Next() {
+			var (
+				s    SpecialistWorkload
+				last sql.NullTime
+			)
+			if err := rows.Scan(&s.SpecialistID, &s.Name, &s.Active, &s.Checklists, &s.Children, &last); err != nil {
+				return err
+			}
+			s.LastCheckDate = datePtr(last)
+			items = append(items, s)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx,
+			`SELECT count(*) FROM checklists c WHERE c.specialist_id IS NULL AND `+filter, args...).Scan(&unlinked)
+	})
+	if err != nil {
+		writeStatusError(w, r, err, "failed to compute workload")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": items, "unlinked": unlinked})
+}
+
+// validateSpecialistInput trims the fields of in.
+func validateSpecialistInput(in *specialistInput) error {
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" {
+		return errors.New("name must be provided")
+	}
+	if in.Email != nil {
+		e := strings.ToLower(strings.TrimSpace(*in.Email))
+		if e != "" && !strings.Contains(e, "@") {
+			return errors.New("email is not valid")
+		}
+		in.Email = &e
+	}
+	in.Role = strings.ToLower(strings.TrimSpace(in.Role))
+	if in.Role != "" && !validRole(in.Role) {
+		return errors.New("role must be admin, specialist or viewer")
+	}
+	return nil
+}
+
+// linkSpecialist resolves c.SpecialistID, when set, within the organization
+// of ctx and copies the specialist's name into c.Specialist. New checklists
+// cannot be filed under a deactivated specialist; corrections of existing
+// ones can.
+func linkSpecialist(ctx context.Context, q queryer, c *Checklist, requireActive bool) error {
+	if c.SpecialistID == nil {
+		return nil
+	}
+	var (
+		name          string
+		deactivatedAt sql.NullTime
+	)
+	err := q.QueryRowContext(ctx, `SELECT name, deactivated_at FROM specialists WHERE id = $1 AND org_id = $2`,
+		*c.SpecialistID, orgFrom(ctx)).Scan(&name, &deactivatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errUnknownSpecialist
+	}
+	if err != nil {
+		return fmt.Errorf("load specialist: %w", err)
+	}
+	if requireActive && deactivatedAt.Valid {
+		return errSpecialistInactive
+	}
+	c.Specialist = &name
+	return nil
+}
+
+func loadSpecialist(ctx context.Context, q queryer, id int64) (Specialist, error) {
+	return scanSpecialist(q.QueryRowContext(ctx, `SELECT `+specialistColumns+` FROM specialists s WHERE s.id = $1 AND s.org_id = $2`,
+		id, orgFrom(ctx)))
+}
+
+func scanSpecialist(row rowScanner) (Specialist, error) {
+	var (
+		s                Specialist
+		position, email  sql.NullString
+		login            sql.NullString
+		deactivated, upd sql.NullTime
+	)
+	if err := row.Scan(&s.ID, &s.Name, &position, &email, &login, &s.Role, &deactivated, &s.CreatedAt, &upd); err != nil {
+		return s, err
+	}
+	s.Position, s.Email, s.DeactivatedAt, s.UpdatedAt = stringPtr(position), stringPtr(email), timePtr(deactivated), timePtr(upd)
+	s.Login, s.Active = stringPtr(login), !deactivated.Valid
+	return s, nil
+}
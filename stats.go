@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// defaultReliabilityWindowDays is how far apart two assessments of the same
+// child by different specialists may be to count as a rating pair.
+const defaultReliabilityWindowDays = 14
+
+// Default interval between a test and its retest, in days.
+const (
+	defaultRetestMinDays = 7
+	defaultRetestMaxDays = 30
+)
+
+// QuestionReliability summarises how consistently a question is answered
+// across pairs of assessments of the same child.
+type QuestionReliability struct {
+	Key        string   `json:"key"`
+	Label      string   `json:"label"`
+	Pairs      int      `json:"pairs"`
+	Agreements int      `json:"agreements"`
+	Agreement  float64  `json:"agreement"`
+	Kappa      *float64 `json:"kappa"` // null when every pair used a single value
+}
+
+// reliabilityHandler handles GET /api/stats/reliability?window_days=N
+func reliabilityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	window := defaultReliabilityWindowDays
+	if v := r.URL.Query().Get("window_days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 365 {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "window_days must be an integer between 0 and 365")
+			return
+		}
+		window = n
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	items, err := questionReliability(ctx, window)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to compute reliability")
+		log.Printf("reliability stats error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"windowDays": window, "items": items}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// questionReliability pairs checklists of the same child made by different
+// specialists no more than window days apart and compares their answers per
+// question. Only checklists of the organization of ctx are paired.
+func questionReliability(ctx context.Context, window int) ([]QuestionReliability, error) {
+	return compareAnswerPairs(ctx, `
+SELECT c1.id AS id1, c2.id AS id2
+FROM checklists c1
+JOIN checklists c2
+  ON c2.org_id = c1.org_id
+ AND lower(c2.child_name) = lower(c1.child_name)
+ AND c2.id > c1.id
+ AND lower(c2.specialist) <> lower(c1.specialist)
+ AND abs(c2.date_of_check - c1.date_of_check) <= $1
+WHERE c1.org_id = $2 AND c1.archived_at IS NULL AND c2.archived_at IS NULL`, window, orgFrom(ctx))
+}
+
+// compareAnswerPairs compares answers question by question across the
+// checklist pairs (id1, id2) produced by pairsQuery. Items are ordered from
+// the least to the most consistent.
+func compareAnswerPairs(ctx context.Context, pairsQuery string, args ...interface{}) ([]QuestionReliability, error) {
+	type cell struct {
+		v1, v2 string
+		n      int
+	}
+	var (
+		labels map[string]string
+		cells  map[string][]cell
+	)
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `
+WITH pairs AS (`+pairsQuery+`
+)
+SELECT a1.key_name, max(COALESCE(a1.label, '')), a1.value, a2.value, count(*)
+FROM pairs p
+JOIN answers a1 ON a1.checklist_id = p.id1
+JOIN answers a2 ON a2.checklist_id = p.id2 AND a2.key_name = a1.key_name
+WHERE a1.value IS NOT NULL AND a2.value IS NOT NULL
+GROUP BY a1.key_name, a1.value, a2.value`, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		labels, cells = make(map[string]string), make(map[string][]cell)
+		for rows.Next() {
+			var (
+				key, label string
+				c          cell
+			)
+			if err := rows.Scan(&key, &label, &c.v1, &c.v2, &c.n); err != nil {
+				return err
+			}
+			if label != "" {
+				labels[key] = label
+			}
+			cells[key] = append(cells[key], c)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]QuestionReliability, 0, len(cells))
+	for key, cs := range cells {
+		q := QuestionReliability{Key: key, Label: labels[key]}
+		// Which checklist is "first" in a pair is arbitrary for inter-rater
+		// pairs, so chance agreement uses the pooled value distribution.
+		pooled := make(map[string]int)
+		for _, c := range cs {
+			q.Pairs += c.n
+			if c.v1 == c.v2 {
+				q.Agreements += c.n
+			}
+			pooled[c.v1] += c.n
+			pooled[c.v2] += c.n
+		}
+		q.Agreement = float64(q.Agreements) / float64(q.Pairs)
+
+		var expected float64
+		for _, n := range pooled {
+			p := float64(n) / float64(2*q.Pairs)
+			expected += p * p
+		}
+		if expected < 1 {
+			k := (q.Agreement - expected) / (1 - expected)
+			q.Kappa = &k
+		}
+		items = append(items, q)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Agreement != items[j].Agreement {
+			return items[i].Agreement < items[j].Agreement
+		}
+		return items[i].Key < items[j].Key
+	})
+	return items, nil
+}
+
+// testRetestHandler handles GET /api/stats/test-retest?min_days=N&max_days=M.
+// Each child's consecutive assessments separated by min_days..max_days are
+// paired and answer stability is reported per question across the cohort.
+func testRetestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	minDays, maxDays := defaultRetestMinDays, defaultRetestMaxDays
+	q := r.URL.Query()
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"min_days", &minDays}, {"max_days", &maxDays}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 3650 {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, p.name+" must be an integer between 0 and 3650")
+			return
+		}
+		*p.dst = n
+	}
+	if minDays > maxDays {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "min_days must not exceed max_days")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	items, err := testRetestStability(ctx, minDays, maxDays)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to compute test-retest stability")
+		log.Printf("test-retest stats error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"minDays": minDays, "maxDays": maxDays, "items": items}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func testRetestStability(ctx context.Context, minDays, maxDays int) ([]QuestionReliability, error) {
+	return compareAnswerPairs(ctx, `
+SELECT id AS id1, next_id AS id2
+FROM (
+  SELECT id, date_of_check,
+         lead(id) OVER w AS next_id,
+         lead(date_of_check) OVER w AS next_date
+  FROM checklists
+  WHERE org_id = $3 AND child_name IS NOT NULL AND date_of_check IS NOT NULL AND archived_at IS NULL
+  WINDOW w AS (PARTITION BY lower(child_name) ORDER BY date_of_check, id)
+) o
+WHERE next_id IS NOT NULL AND next_date - date_of_check BETWEEN $1 AND $2`, minDays, maxDays, orgFrom(ctx))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// storageTables are the tables whose size the storage report shows: the
+// ones that grow with use.
+var storageTables = []string{"checklists", "answers", "events", "import_job_items", "write_journal"}
+
+// TableStorage is the on-disk size of a table. Toast is the TOAST table
+// holding long values, such as comments, out of line.
+type TableStorage struct {
+	Name       string `json:"name"`
+	TotalBytes int64  `json:"totalBytes"`
+	HeapBytes  int64  `json:"heapBytes"`
+	ToastBytes int64  `json:"toastBytes"`
+	IndexBytes int64  `json:"indexBytes"`
+}
+
+// CommentStorage compares the length of the answer comments with the space
+// Postgres stores them in, after compression.
+type CommentStorage struct {
+	Comments    int64   `json:"comments"`
+	Compressed  int64   `json:"compressed"`
+	RawBytes    int64   `json:"rawBytes"`
+	StoredBytes int64   `json:"storedBytes"`
+	SavedBytes  int64   `json:"savedBytes"`
+	Ratio       float64 `json:"ratio"`
+}
+
+// storageHandler handles GET /api/admin/storage: the size of the largest
+// tables and how well answer comments compress. The figures cover the whole
+// database, so only operators see them.
+func storageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !isOperator(r.Context()) {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "storage is reported to the administrators of the first organization")
+		return
+	}
+
+	// measuring the comments reads the whole answers table
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+
+	tables, err := tableStorage(ctx)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to measure tables")
+		log.Printf("table storage error: %v", err)
+		return
+	}
+	comments, err := commentStorage(ctx)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to measure comments")
+		log.Printf("comment storage error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"tables": tables, "comments": comments})
+}
+
+func tableStorage(ctx context.Context) ([]TableStorage, error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT c.relname, pg_total_relation_size(c.oid), pg_relation_size(c.oid),
+       COALESCE(pg_total_relation_size(NULLIF(c.reltoastrelid, 0)), 0), pg_indexes_size(c.oid)
+FROM pg_class c
+WHERE c.relname = ANY($1) AND c.relkind = 'r' AND c.relnamespace = current_schema()::regnamespace
+ORDER BY pg_total_relation_size(c.oid) DESC`, pq.Array(storageTables))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := []TableStorage{}
+	for rows.Next() {
+		var t TableStorage
+		if err := rows.Scan(&t.Name, &t.TotalBytes, &t.HeapBytes, &t.ToastBytes, &t.IndexBytes); err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	return tables, rows.Err()
+}
+
+// commentStorage measures the answer comments. octet_length gives the
+// length of a value and pg_column_size the space it takes, neither
+// decompressing it.
+func commentStorage(ctx context.Context) (CommentStorage, error) {
+	var s CommentStorage
+	err := inTx(ctx, snapshotTx, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, `
+SELECT count(*), count(*) FILTER (WHERE pg_column_size(comment) < octet_length(comment)),
+       COALESCE(sum(octet_length(comment)), 0), COALESCE(sum(pg_column_size(comment)), 0)
+FROM answers WHERE comment IS NOT NULL`).Scan(&s.Comments, &s.Compressed, &s.RawBytes, &s.StoredBytes)
+	})
+	if err != nil {
+		return s, err
+	}
+	s.SavedBytes = s.RawBytes - s.StoredBytes
+	if s.StoredBytes > 0 {
+		s.Ratio = float64(s.RawBytes) / float64(s.StoredBytes)
+	}
+	return s, nil
+}
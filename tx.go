@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maxTxAttempts bounds how often inTx runs a transaction that keeps failing
+// with serialization failures or deadlocks.
+const maxTxAttempts = 3
+
+// snapshotTx is for reads: reports made of several queries that must agree
+// with each other, and any read of the tables under row-level security,
+// whose policies need the settings beginTx applies. Writes pass nil options
+// (READ COMMITTED): they lock the rows they change; a check that no row
+// lock covers can pass sql.LevelSerializable and rely on the retries below.
+var snapshotTx = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+
+// inTx runs fn in a transaction with the given options and commits it when
+// fn returns nil; otherwise the transaction is rolled back and fn's error
+// returned. A transaction failing with a serialization failure or a deadlock
+// is retried with a fresh transaction, so fn may run more than once and must
+// not do anything outside tx, such as writing the response or appending to
+// variables declared outside it.
+func inTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := runTx(ctx, opts, fn)
+		if err == nil || !retryableTxError(err) || attempt == maxTxAttempts || ctx.Err() != nil {
+			return err
+		}
+		time.Sleep(time.Duration(attempt*10+rand.IntN(10)) * time.Millisecond)
+	}
+}
+
+func runTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	tx, err := beginTx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// retryableTxError reports whether err is a serialization_failure or a
+// deadlock_detected, after which the whole transaction can be run again.
+func retryableTxError(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "40001" || pqErr.Code == "40P01")
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Database credentials from HashiCorp Vault. With VAULT_ADDR and
+// VAULT_DB_ROLE set the user and password of PG_DSN are replaced by dynamic
+// credentials of the database secrets engine, whose lease is renewed in the
+// background and replaced by new credentials when it can no longer be
+// renewed.
+const (
+	defaultVaultDBMount = "database"
+	vaultRetryInterval  = 30 * time.Second
+	maxDBConnLifetime   = 30 * time.Minute
+	minDBConnLifetime   = time.Minute
+)
+
+type vaultClient struct {
+	addr, token string
+	mount, role string
+	client      *http.Client
+}
+
+// vaultLease is a lease on database credentials.
+type vaultLease struct {
+	id        string
+	duration  time.Duration
+	renewable bool
+}
+
+// newVaultClient returns nil when Vault is not configured.
+func newVaultClient() *vaultClient {
+	addr, role := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_DB_ROLE")
+	if addr == "" && role == "" {
+		return nil
+	}
+	if addr == "" || role == "" {
+		log.Fatal("VAULT_ADDR and VAULT_DB_ROLE must be set together")
+	}
+	token := secretEnv("VAULT_TOKEN")
+	if token == "" {
+		log.Fatal("VAULT_TOKEN or VAULT_TOKEN_FILE is required with VAULT_ADDR")
+	}
+	mount := os.Getenv("VAULT_DB_MOUNT")
+	if mount == "" {
+		mount = defaultVaultDBMount
+	}
+	return &vaultClient{
+		addr:   strings.TrimRight(addr, "/"),
+		token:  token,
+		mount:  strings.Trim(mount, "/"),
+		role:   role,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// call sends a request to the Vault HTTP API and decodes the response into out.
+func (v *vaultClient) call(ctx context.Context, method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+"/v1/"+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("vault %s %s: %s %s", method, path, resp.Status, strings.Join(e.Errors, "; "))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// dbCredentials requests new database credentials.
+func (v *vaultClient) dbCredentials(ctx context.Context) (string, string, vaultLease, error) {
+	var resp struct {
+		LeaseID       string `json:"lease_id"`
+		LeaseDuration int64  `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+		Data          struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"data"`
+	}
+	if err := v.call(ctx, http.MethodGet, v.mount+"/creds/"+v.role, nil, &resp); err != nil {
+		return "", "", vaultLease{}, err
+	}
+	if resp.Data.Username == "" {
+		return "", "", vaultLease{}, fmt.Errorf("vault returned no username for role %q", v.role)
+	}
+	lease := vaultLease{id: resp.LeaseID, duration: time.Duration(resp.LeaseDuration) * time.Second, renewable: resp.Renewable}
+	return resp.Data.Username, resp.Data.Password, lease, nil
+}
+
+// renew extends the lease by its original duration and returns the
+// duration granted, which is shorter once the lease nears its max TTL.
+func (v *vaultClient) renew(ctx context.Context, lease vaultLease) (time.Duration, error) {
+	var resp struct {
+		LeaseDuration int64 `json:"lease_duration"`
+	}
+	in := map[string]interface{}{"lease_id": lease.id, "increment": int64(lease.duration / time.Second)}
+	if err := v.call(ctx, http.MethodPut, "sys/leases/renew", in, &resp); err != nil {
+		return 0, err
+	}
+	return time.Duration(resp.LeaseDuration) * time.Second, nil
+}
+
+// withCredentials returns dsn (URL or key=value form) with user and password
+// replaced.
+func withCredentials(dsn, user, password string) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			return "", err
+		}
+	}
+	quote := func(s string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+	}
+	// later keys override earlier ones
+	return dsn + " user=" + quote(user) + " password=" + quote(password), nil
+}
+
+// dbConnLifetime keeps connections well within the credential lease, so
+// that none outlives the credentials it was opened with.
+func dbConnLifetime(lease vaultLease) time.Duration {
+	if lease.duration <= 0 {
+		return maxDBConnLifetime
+	}
+	return max(minDBConnLifetime, min(maxDBConnLifetime, lease.duration/3))
+}
+
+// openVaultDB opens the pool with credentials from Vault and starts their
+// renewal.
+func openVaultDB(v *vaultClient, dsn string) *sql.DB {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	user, password, lease, err := v.dbCredentials(ctx)
+	if err != nil {
+		log.Fatalf("failed to get database credentials from vault: %v", err)
+	}
+	withCreds, err := withCredentials(dsn, user, password)
+	if err != nil {
+		log.Fatalf("invalid PG_DSN: %v", err)
+	}
+	connector := newRotatingConnector(withCreds)
+	pool := sql.OpenDB(connector)
+	pool.SetConnMaxLifetime(dbConnLifetime(lease))
+	log.Printf("using vault database credentials %q (lease %s)", user, lease.duration)
+	reload := make(chan struct{}, 1)
+	watchCredentialReload(func() {
+		select {
+		case reload <- struct{}{}:
+		default:
+		}
+	})
+	go renewVaultCredentials(v, pool, connector, dsn, lease, reload)
+	return pool
+}
+
+// renewVaultCredentials renews the lease at two thirds of its duration. When
+// Vault no longer renews it for at least half its duration (the max TTL is
+// near), renewal fails or a reload is requested, it switches to new
+// credentials and the connections opened with the old ones are drained.
+func renewVaultCredentials(v *vaultClient, pool *sql.DB, connector *rotatingConnector, dsn string, lease vaultLease, reload <-chan struct{}) {
+	wait := lease.duration * 2 / 3
+	for {
+		forced := false
+		if lease.duration > 0 {
+			select {
+			case <-time.After(wait):
+			case <-reload:
+				forced = true
+			}
+		} else {
+			<-reload
+			forced = true
+		}
+		if forced {
+			// the token may have been rotated along with the credentials
+			if token, err := readSecretEnv("VAULT_TOKEN"); err != nil {
+				log.Printf("vault token not reloaded: %v", err)
+			} else if token != "" {
+				v.token = token
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if lease.renewable && !forced {
+			d, err := v.renew(ctx, lease)
+			if err == nil && d >= lease.duration/2 {
+				cancel()
+				wait = d * 2 / 3
+				continue
+			}
+			if err != nil {
+				log.Printf("vault lease renewal failed, requesting new credentials: %v", err)
+			}
+		}
+		user, password, next, err := v.dbCredentials(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("failed to get database credentials from vault: %v", err)
+			wait = vaultRetryInterval
+			continue
+		}
+		withCreds, err := withCredentials(dsn, user, password)
+		if err != nil {
+			log.Printf("failed to apply vault credentials: %v", err)
+			wait = vaultRetryInterval
+			continue
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		err = connector.set(ctx, withCreds)
+		cancel()
+		if err != nil {
+			log.Printf("failed to connect with new vault credentials: %v", err)
+			wait = vaultRetryInterval
+			continue
+		}
+		pool.SetConnMaxLifetime(dbConnLifetime(next))
+		log.Printf("switched to new vault database credentials %q (lease %s)", user, next.duration)
+		lease, wait = next, next.duration*2/3
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// xlsxMaxSheets caps the checklists of one XLSX export; each becomes a sheet
+// and spreadsheet applications get slow with many more.
+const xlsxMaxSheets = 500
+
+// Cell styles defined in xlsxStyles.
+const (
+	xlsxStyleDefault = 0
+	xlsxStyleBold    = 1
+	xlsxStyleWrap    = 2
+)
+
+const xlsxContentTypesHead = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>
+`
+
+const xlsxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`
+
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="3">
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>
+<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0" applyAlignment="1"><alignment vertical="top" wrapText="1"/></xf>
+</cellXfs>
+</styleSheet>`
+
+// xlsxWriter streams a workbook with one sheet per checklist. Sheets are
+// written as they come; the workbook parts listing them are written by Close.
+type xlsxWriter struct {
+	zw     *zip.Writer
+	sheets []string
+}
+
+func newXLSXWriter(w io.Writer) *xlsxWriter {
+	return &xlsxWriter{zw: zip.NewWriter(w)}
+}
+
+// writeXLSX writes the checklists of rows (see queryExportRows) as a workbook.
+func writeXLSX(w io.Writer, rows *sql.Rows) error {
+	xw := newXLSXWriter(w)
+	if err := forEachExportChecklist(rows, xw.WriteChecklist); err != nil {
+		return err
+	}
+	return xw.Close()
+}
+
+// WriteChecklist adds a sheet with the checklist header followed by a
+// question/value/comment table.
+func (x *xlsxWriter) WriteChecklist(c ChecklistDetail) error {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<cols><col min="1" max="1" width="50" customWidth="1"/><col min="2" max="2" width="20" customWidth="1"/><col min="3" max="3" width="50" customWidth="1"/></cols>
+<sheetData>`)
+	row := 0
+	// addRow writes cells from column A on; the first cell gets captionStyle
+	addRow := func(captionStyle, style int, cells ...string) {
+		row++
+		fmt.Fprintf(&b, `<row r="%d">`, row)
+		for i, v := range cells {
+			s := style
+			if i == 0 {
+				s = captionStyle
+			}
+			fmt.Fprintf(&b, `<c r="%c%d" t="inlineStr" s="%d"><is><t xml:space="preserve">`, 'A'+i, row, s)
+			_ = xml.EscapeText(&b, []byte(v))
+			b.WriteString(`</t></is></c>`)
+		}
+		b.WriteString(`</row>`)
+	}
+
+	addRow(xlsxStyleBold, xlsxStyleDefault, "Чек-лист", strconv.FormatInt(c.ID, 10))
+	addRow(xlsxStyleBold, xlsxStyleDefault, "Ребёнок", deref(c.ChildName))
+	addRow(xlsxStyleBold, xlsxStyleDefault, "Дата обследования", deref(c.Date))
+	addRow(xlsxStyleBold, xlsxStyleDefault, "Специалист", deref(c.Specialist))
+	row++ // blank line before the table
+	addRow(xlsxStyleBold, xlsxStyleBold, "Вопрос", "Ответ", "Комментарий")
+	for _, a := range c.Answers {
+		question := a.Label
+		if question == "" {
+			question = a.Key
+		}
+		addRow(xlsxStyleWrap, xlsxStyleWrap, question, deref(a.Value), deref(a.Comment))
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+
+	f, err := x.zw.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", len(x.sheets)+1))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		return err
+	}
+	x.sheets = append(x.sheets, sheetName(c))
+	return nil
+}
+
+// sheetName builds a sheet name of at most 31 characters without the
+// characters Excel forbids, e.g. "123 Иванов Иван". The leading checklist id
+// keeps names unique.
+func sheetName(c ChecklistDetail) string {
+	name := strconv.FormatInt(c.ID, 10)
+	if c.ChildName != nil {
+		name += " " + strings.Map(func(r rune) rune {
+			if strings.ContainsRune(`[]:*?/\'`, r) {
+				return '_'
+			}
+			return r
+		}, *c.ChildName)
+	}
+	for utf8.RuneCountInString(name) > 31 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return strings.TrimSpace(name)
+}
+
+// Close writes the parts describing the sheets and finishes the archive.
+func (x *xlsxWriter) Close() error {
+	if len(x.sheets) == 0 {
+		// a workbook needs at least one sheet
+		if err := x.WriteChecklist(ChecklistDetail{}); err != nil {
+			return err
+		}
+		x.sheets[0] = "Нет данных"
+	}
+
+	var ct, wb, rels bytes.Buffer
+	ct.WriteString(xlsxContentTypesHead)
+	wb.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	rels.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rIdStyles" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+`)
+	for i, name := range x.sheets {
+		n := i + 1
+		fmt.Fprintf(&ct, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`+"\n", n)
+		fmt.Fprintf(&wb, `<sheet name="`)
+		_ = xml.EscapeText(&wb, []byte(name))
+		fmt.Fprintf(&wb, `" sheetId="%d" r:id="rId%d"/>`, n, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`+"\n", n, n)
+	}
+	ct.WriteString(`</Types>`)
+	wb.WriteString(`</sheets></workbook>`)
+	rels.WriteString(`</Relationships>`)
+
+	for _, part := range []struct {
+		name string
+		data []byte
+	}{
+		{"[Content_Types].xml", ct.Bytes()},
+		{"_rels/.rels", []byte(xlsxRootRels)},
+		{"xl/workbook.xml", wb.Bytes()},
+		{"xl/_rels/workbook.xml.rels", rels.Bytes()},
+		{"xl/styles.xml", []byte(xlsxStyles)},
+	} {
+		f, err := x.zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(part.data); err != nil {
+			return err
+		}
+	}
+	return x.zw.Close()
+}